@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read if it exists and --config isn't given
+const defaultConfigFile = "dbmate.yml"
+
+// settings are the options which can be given in a config file, either at the
+// top level or for a named environment
+type settings struct {
+	URL             string `yaml:"url"`
+	MigrationsDir   string `yaml:"migrations_dir"`
+	MigrationsTable string `yaml:"migrations_table"`
+	Project         string `yaml:"project"`
+	SchemaFile      string `yaml:"schema_file"`
+	Timeout         int    `yaml:"timeout"`
+}
+
+// config is the contents of a dbmate.yml file. Top level settings apply to
+// every environment, and those given for an environment override them.
+type config struct {
+	Settings     settings            `yaml:",inline"`
+	Environments map[string]settings `yaml:"environments"`
+}
+
+// loadSettings reads the config file and returns the settings for the
+// environment chosen with --environment. It returns empty settings if no
+// config file was given and the default one doesn't exist.
+func loadSettings(c *cli.Context) (settings, error) {
+	path := c.GlobalString("config")
+	env := c.GlobalString("environment")
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !c.GlobalIsSet("config") {
+		if env != "" {
+			return settings{}, fmt.Errorf("can't use environment %s: %s not found", env, path)
+		}
+		return settings{}, nil
+	}
+	if err != nil {
+		return settings{}, err
+	}
+
+	cfg, err := parseConfig(contents)
+	if err != nil {
+		return settings{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	s, err := cfg.environment(env)
+	if err != nil {
+		return settings{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return s, nil
+}
+
+// parseConfig parses a config file, rejecting unknown keys
+func parseConfig(contents []byte) (config, error) {
+	cfg := config{}
+	dec := yaml.NewDecoder(bytes.NewReader(contents))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// environment merges the settings for a named environment over the top level
+// settings, and expands any ${VAR} references in them
+func (cfg config) environment(name string) (settings, error) {
+	s := cfg.Settings
+	if name != "" {
+		env, ok := cfg.Environments[name]
+		if !ok {
+			return s, fmt.Errorf("environment %s not found (expected one of %s)",
+				name, strings.Join(cfg.environmentNames(), ", "))
+		}
+
+		if env.URL != "" {
+			s.URL = env.URL
+		}
+		if env.MigrationsDir != "" {
+			s.MigrationsDir = env.MigrationsDir
+		}
+		if env.MigrationsTable != "" {
+			s.MigrationsTable = env.MigrationsTable
+		}
+		if env.Project != "" {
+			s.Project = env.Project
+		}
+		if env.SchemaFile != "" {
+			s.SchemaFile = env.SchemaFile
+		}
+		if env.Timeout != 0 {
+			s.Timeout = env.Timeout
+		}
+	}
+
+	for _, value := range []*string{&s.URL, &s.MigrationsDir, &s.MigrationsTable, &s.Project, &s.SchemaFile} {
+		expanded, err := expandVars(*value)
+		if err != nil {
+			return s, err
+		}
+		*value = expanded
+	}
+
+	return s, nil
+}
+
+func (cfg config) environmentNames() []string {
+	names := []string{}
+	for name := range cfg.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandVars replaces each ${VAR} in a value with the environment variable of
+// that name, and returns an error if any of them aren't set
+func expandVars(value string) (string, error) {
+	var err error
+	expanded := varPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := varPattern.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+
+	return expanded, err
+}
+
+// apply sets the global flags which weren't given on the command line to the
+// values from the config file
+func (s settings) apply(c *cli.Context) error {
+	values := map[string]string{
+		"migrations-dir":   s.MigrationsDir,
+		"migrations-table": s.MigrationsTable,
+		"project":          s.Project,
+		"schema-file":      s.SchemaFile,
+	}
+	if s.Timeout != 0 {
+		values["timeout"] = strconv.Itoa(s.Timeout)
+	}
+
+	for name, value := range values {
+		if value == "" || c.GlobalIsSet(name) {
+			continue
+		}
+		if err := c.GlobalSet(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
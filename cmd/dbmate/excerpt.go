@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/turnitin/dbmate"
+)
+
+// excerptLines is how many lines are shown either side of the failing line
+const excerptLines = 2
+
+// withExcerpt adds an excerpt of the migration file to an error from a failed
+// migration, if it reports the failing line. The error is returned unchanged
+// if the file can't be read.
+func withExcerpt(err error, migrationsDir string) error {
+	var migErr *dbmate.MigrationError
+	if !errors.As(err, &migErr) || migErr.Line == 0 {
+		return err
+	}
+
+	contents, readErr := ioutil.ReadFile(filepath.Join(migrationsDir, migErr.Filename))
+	if readErr != nil {
+		return err
+	}
+
+	excerpt := sourceExcerpt(string(contents), migErr.Line, migErr.Column)
+	if excerpt == "" {
+		return err
+	}
+
+	return fmt.Errorf("%w\n\n%s", err, excerpt)
+}
+
+// sourceExcerpt returns the lines of a file around the given line, marking it
+// with > and pointing to the column (if known) with ^
+func sourceExcerpt(contents string, line, column int) string {
+	lines := strings.Split(strings.TrimRight(contents, "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+
+	first, last := line-excerptLines, line+excerptLines
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(fmt.Sprint(last))
+
+	var b strings.Builder
+	for n := first; n <= last; n++ {
+		text := strings.TrimRight(lines[n-1], "\r")
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %*d | %s\n", marker, width, n, text)
+
+		if n == line && column > 0 {
+			fmt.Fprintf(&b, "  %*s | %s^\n", width, "", caretPadding(text, column))
+		}
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// caretPadding returns the whitespace which lines a caret up under a column of
+// text, keeping tabs so it lines up however they are displayed
+func caretPadding(text string, column int) string {
+	var b strings.Builder
+	for i, r := range text {
+		if utf8.RuneCountInString(text[:i]) >= column-1 {
+			break
+		}
+		if r == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+
+	return b.String()
+}
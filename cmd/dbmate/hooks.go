@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/turnitin/dbmate"
+)
+
+// hookEvents are the events which --hook can run shell commands for
+var hookEvents = []string{"before-migrate", "after-migrate", "before-each", "after-each", "on-rollback"}
+
+// parseHooks builds hooks which run shell commands from --hook values of the
+// form EVENT=COMMAND. An event may be given more than once, in which case its
+// commands run in order.
+func parseHooks(values []string) (dbmate.Hooks, error) {
+	commands := map[string][]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return dbmate.Hooks{}, fmt.Errorf("invalid hook: %s (expected EVENT=COMMAND)", value)
+		}
+
+		event := strings.TrimSpace(parts[0])
+		if !validHookEvent(event) {
+			return dbmate.Hooks{}, fmt.Errorf("invalid hook event: %s (expected one of %s)",
+				event, strings.Join(hookEvents, ", "))
+		}
+		commands[event] = append(commands[event], parts[1])
+	}
+
+	hooks := dbmate.Hooks{}
+	if cmds := commands["before-migrate"]; len(cmds) > 0 {
+		hooks.BeforeMigrate = func(ctx context.Context) error {
+			return runHookCommands(ctx, cmds, "before-migrate")
+		}
+	}
+	if cmds := commands["after-migrate"]; len(cmds) > 0 {
+		hooks.AfterMigrate = func(ctx context.Context, applied []string, err error) error {
+			return runHookCommands(ctx, cmds, "after-migrate",
+				"DBMATE_APPLIED="+strings.Join(applied, " "),
+				"DBMATE_ERROR="+errorString(err))
+		}
+	}
+	if cmds := commands["before-each"]; len(cmds) > 0 {
+		hooks.BeforeEach = func(ctx context.Context, version string) error {
+			return runHookCommands(ctx, cmds, "before-each", "DBMATE_VERSION="+version)
+		}
+	}
+	if cmds := commands["after-each"]; len(cmds) > 0 {
+		hooks.AfterEach = func(ctx context.Context, version string, duration time.Duration, err error) error {
+			return runHookCommands(ctx, cmds, "after-each",
+				"DBMATE_VERSION="+version,
+				fmt.Sprintf("DBMATE_DURATION_MS=%d", duration/time.Millisecond),
+				"DBMATE_ERROR="+errorString(err))
+		}
+	}
+	if cmds := commands["on-rollback"]; len(cmds) > 0 {
+		hooks.OnRollback = func(ctx context.Context, version string, duration time.Duration, err error) error {
+			return runHookCommands(ctx, cmds, "on-rollback",
+				"DBMATE_VERSION="+version,
+				fmt.Sprintf("DBMATE_DURATION_MS=%d", duration/time.Millisecond),
+				"DBMATE_ERROR="+errorString(err))
+		}
+	}
+
+	return hooks, nil
+}
+
+func validHookEvent(event string) bool {
+	for _, e := range hookEvents {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runHookCommands runs each command with sh, stopping at the first which
+// fails. Details of the event are passed in DBMATE_* environment variables.
+// Output goes to stderr, so that it isn't mixed with dbmate's own output.
+func runHookCommands(ctx context.Context, commands []string, event string, env ...string) error {
+	for _, command := range commands {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(append(os.Environ(), "DBMATE_HOOK="+event), env...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+	}
+
+	return nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/turnitin/dbmate"
@@ -14,8 +21,18 @@ import (
 func main() {
 	loadDotEnv()
 
+	// cancel the running command on SIGINT or SIGTERM, which rolls back the
+	// migration in progress. A second signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	app := NewApp()
+	app.Metadata = map[string]interface{}{contextKey: ctx}
 	err := app.Run(os.Args)
+	stop()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		os.Exit(1)
@@ -30,26 +47,90 @@ func NewApp() *cli.App {
 	app.Version = dbmate.Version
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config, c",
+			Value: defaultConfigFile,
+			Usage: "specify a config file to read options from",
+		},
+		cli.StringFlag{
+			Name:   "environment, E",
+			EnvVar: "DBMATE_ENVIRONMENT",
+			Usage:  "specify an environment from the config file to use",
+		},
 		cli.StringFlag{
 			Name:  "migrations-dir, d",
 			Value: dbmate.DefaultMigrationsDir,
 			Usage: "specify the directory containing migration files",
 		},
+		cli.StringFlag{
+			Name:  "url, u",
+			Usage: "specify the database URL",
+		},
+		cli.StringFlag{
+			Name:  "url-file",
+			Usage: "specify a file containing the database URL",
+		},
 		cli.StringFlag{
 			Name:  "env, e",
 			Value: "DATABASE_URL",
 			Usage: "specify an environment variable containing the database URL",
 		},
+		cli.StringFlag{
+			Name:  "migrations-table",
+			Value: dbmate.DefaultMigrationsTable,
+			Usage: "specify the table recording applied migrations, optionally qualified with a schema",
+		},
 		cli.StringFlag{
 			Name:  "project, p",
 			Value: "default",
 			Usage: "specify a name to associate with the migration set",
 		},
+		cli.StringFlag{
+			Name:  "schema-file, s",
+			Value: dbmate.DefaultSchemaFile,
+			Usage: "specify the schema file location",
+		},
+		cli.BoolFlag{
+			Name:  "dump-schema",
+			Usage: "write the schema file after every migrate and rollback",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the SQL that migrate and rollback would execute, without running it",
+		},
+		cli.BoolFlag{
+			Name:  "allow-checksum-mismatch",
+			Usage: "migrate even if applied migration files have changed on disk",
+		},
 		cli.IntFlag{
 			Name:  "timeout, t",
-			Value: 30,
+			Value: dbmate.DefaultLockTimeoutSecs,
 			Usage: "specify the max time we'll wait to acquire a migration lock",
 		},
+		cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait for the database to accept connections before running the command",
+		},
+		cli.DurationFlag{
+			Name:  "wait-timeout",
+			Value: dbmate.DefaultWaitTimeout,
+			Usage: "specify the max time we'll wait for the database to accept connections",
+		},
+		cli.StringSliceFlag{
+			Name:  "hook",
+			Value: &cli.StringSlice{},
+			Usage: "run a shell command on a migration event, as EVENT=COMMAND (may be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "output format for log events (text or json)",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "minimum level of log events to output (debug, info, warn or error)",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -57,7 +138,7 @@ func NewApp() *cli.App {
 			Name:    "new",
 			Aliases: []string{"n"},
 			Usage:   "Generate a new migration file",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+			Action: fileAction(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
 				name := c.Args().First()
 				return db.New(name)
 			}),
@@ -65,44 +146,134 @@ func NewApp() *cli.App {
 		{
 			Name:  "up",
 			Usage: "Create database (if necessary) and migrate to the latest version",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Up(c.GlobalInt("timeout"))
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.UpContext(ctx, c.GlobalInt("timeout"))
 			}),
 		},
 		{
 			Name:  "create",
 			Usage: "Create database",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Create()
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.CreateContext(ctx)
 			}),
 		},
 		{
 			Name:  "drop",
 			Usage: "Drop database (if it exists)",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Drop()
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.DropContext(ctx)
 			}),
 		},
 		{
 			Name:  "migrate",
 			Usage: "Migrate to the latest version",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Migrate(c.GlobalInt("timeout"))
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "only apply migrations up to and including this version",
+				},
+			},
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				if c.String("to") != "" {
+					return db.MigrateToContext(ctx, c.GlobalInt("timeout"), c.String("to"))
+				}
+
+				return db.MigrateContext(ctx, c.GlobalInt("timeout"))
 			}),
 		},
 		{
 			Name:  "record-only",
 			Usage: "Record all unapplied migrations but do not actually apply them",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.RecordOnly()
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.RecordOnlyContext(ctx, c.GlobalInt("timeout"))
+			}),
+		},
+		{
+			Name:  "wait",
+			Usage: "Wait for the database to accept connections",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.WaitContext(ctx)
+			}),
+		},
+		{
+			Name:  "dump",
+			Usage: "Write the database schema to disk",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.DumpSchemaContext(ctx)
+			}),
+		},
+		{
+			Name:  "load",
+			Usage: "Create database (if necessary) and load the schema file",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.LoadSchemaContext(ctx)
+			}),
+		},
+		{
+			Name:  "status",
+			Usage: "List applied and pending migrations, exiting non-zero if any are pending",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				statuses, err := db.StatusContext(ctx)
+				if err != nil {
+					return err
+				}
+
+				return printStatus(statuses)
+			}),
+		},
+		{
+			Name:  "verify",
+			Usage: "Check that applied migration files have not changed on disk",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.VerifyContext(ctx)
+			}),
+		},
+		{
+			Name:  "repair",
+			Usage: "Record the current checksum of applied migration files which have changed",
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.RepairContext(ctx)
 			}),
 		},
 		{
 			Name:    "rollback",
 			Aliases: []string{"down"},
 			Usage:   "Rollback the most recent migration",
-			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Rollback()
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "steps",
+					Value: 1,
+					Usage: "number of migrations to roll back",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "roll back every migration applied after this version",
+				},
+			},
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				if c.String("to") != "" {
+					if c.IsSet("steps") {
+						return fmt.Errorf("--steps and --to cannot be used together")
+					}
+
+					return db.RollbackToContext(ctx, c.GlobalInt("timeout"), c.String("to"))
+				}
+
+				return db.RollbackStepsContext(ctx, c.GlobalInt("timeout"), c.Int("steps"))
+			}),
+		},
+		{
+			Name:  "redo",
+			Usage: "Rollback the most recent migration and apply it again",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "steps",
+					Value: 1,
+					Usage: "number of migrations to roll back and apply again",
+				},
+			},
+			Action: action(func(ctx context.Context, db *dbmate.DB, c *cli.Context) error {
+				return db.RedoStepsContext(ctx, c.GlobalInt("timeout"), c.Int("steps"))
 			}),
 		},
 	}
@@ -121,25 +292,188 @@ func loadDotEnv() {
 	}
 }
 
+// contextKey is the app metadata key holding the context commands run with
+const contextKey = "context"
+
 // action wraps a cli.ActionFunc with dbmate initialization logic
-func action(f func(*dbmate.DB, *cli.Context) error) cli.ActionFunc {
+func action(f func(context.Context, *dbmate.DB, *cli.Context) error) cli.ActionFunc {
+	return newAction(f, true)
+}
+
+// fileAction is like action, for commands which only work with the migration
+// files, so don't need a database URL
+func fileAction(f func(context.Context, *dbmate.DB, *cli.Context) error) cli.ActionFunc {
+	return newAction(f, false)
+}
+
+func newAction(f func(context.Context, *dbmate.DB, *cli.Context) error, needsURL bool) cli.ActionFunc {
 	return func(c *cli.Context) error {
-		u, err := getDatabaseURL(c)
+		s, err := loadSettings(c)
+		if err != nil {
+			return err
+		}
+		if err := s.apply(c); err != nil {
+			return err
+		}
+		logger, err := getLogger(c)
+		if err != nil {
+			return err
+		}
+		var u *url.URL
+		if needsURL {
+			u, err = getDatabaseURL(c, s)
+			if err != nil {
+				return err
+			}
+			logger.Log(dbmate.Event{Time: time.Now(), Level: dbmate.LevelDebug, Name: dbmate.EventDatabaseURL,
+				Message: "Using database: " + u.Redacted()})
+		}
+		hooks, err := parseHooks(c.GlobalStringSlice("hook"))
 		if err != nil {
 			return err
 		}
 		db := dbmate.NewDB(u)
+		db.Hooks = hooks
+		db.Logger = logger
 		db.MigrationsDir = c.GlobalString("migrations-dir")
+		db.MigrationsTable = c.GlobalString("migrations-table")
 		db.Project = c.GlobalString("project")
+		db.SchemaFile = c.GlobalString("schema-file")
+		db.AutoDumpSchema = c.GlobalBool("dump-schema")
+		db.DryRun = c.GlobalBool("dry-run")
+		db.AllowChecksumMismatch = c.GlobalBool("allow-checksum-mismatch")
+		db.WaitBefore = c.GlobalBool("wait")
+		db.WaitTimeout = c.GlobalDuration("wait-timeout")
+
+		ctx, ok := c.App.Metadata[contextKey].(context.Context)
+		if !ok {
+			ctx = context.Background()
+		}
+
+		return withExcerpt(f(ctx, db, c), db.MigrationsDir)
+	}
+}
+
+// getLogger builds a logger from the --log-format and --log-level flags
+func getLogger(c *cli.Context) (dbmate.Logger, error) {
+	level, err := dbmate.ParseLogLevel(c.GlobalString("log-level"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch format := c.GlobalString("log-format"); format {
+	case "text":
+		return dbmate.NewTextLogger(os.Stdout, level), nil
+	case "json":
+		return dbmate.NewJSONLogger(os.Stdout, level), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s (expected text or json)", format)
+	}
+}
+
+// printStatus writes one line per migration and returns an error if any are pending
+func printStatus(statuses []dbmate.MigrationStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	pending := 0
+	for _, s := range statuses {
+		name := s.Filename
+		switch s.State {
+		case dbmate.MigrationPending:
+			pending++
+		case dbmate.MigrationMissing:
+			name = fmt.Sprintf("%s (migration file not found)", s.Version)
+		}
+
+		appliedAt, duration, checksum := "", "", ""
+		if !s.AppliedAt.IsZero() {
+			appliedAt = s.AppliedAt.UTC().Format("2006-01-02 15:04:05 UTC")
+		}
+		if !s.AppliedAt.IsZero() && s.ExecutionMs >= 0 {
+			duration = fmt.Sprintf("%dms", s.ExecutionMs)
+		}
+		if len(s.Checksum) > 12 {
+			checksum = s.Checksum[:12]
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.State, name, appliedAt, duration, checksum)
+	}
 
-		return f(db, c)
+	if err := w.Flush(); err != nil {
+		return err
 	}
+
+	if pending > 0 {
+		return fmt.Errorf("%d pending migration(s)", pending)
+	}
+
+	return nil
+}
+
+// getDatabaseURL returns the database URL from --url, --url-file, the config
+// file or an environment variable, in that order, checking that it's valid
+func getDatabaseURL(c *cli.Context, s settings) (*url.URL, error) {
+	value, source, err := databaseURLValue(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDatabaseURL(value, source)
 }
 
-// getDatabaseURL returns the current environment database url
-func getDatabaseURL(c *cli.Context) (u *url.URL, err error) {
+// databaseURLValue returns the database URL, and a description of where it
+// came from for error messages
+func databaseURLValue(c *cli.Context, s settings) (string, string, error) {
+	if c.GlobalIsSet("url") && c.GlobalIsSet("url-file") {
+		return "", "", fmt.Errorf("--url and --url-file cannot be used together")
+	}
+	if c.GlobalIsSet("url") {
+		return c.GlobalString("url"), "--url", nil
+	}
+	if path := c.GlobalString("url-file"); path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("can't read database URL: %s", err)
+		}
+		return strings.TrimSpace(string(contents)), path, nil
+	}
+
+	// the config file takes precedence over the environment, unless the
+	// environment variable was named on the command line
+	if s.URL != "" && !c.GlobalIsSet("env") {
+		return s.URL, c.GlobalString("config"), nil
+	}
+
 	env := c.GlobalString("env")
 	value := os.Getenv(env)
+	if value == "" {
+		return "", "", fmt.Errorf("environment variable %s is not set "+
+			"(set it, or pass --url or --url-file)", env)
+	}
+
+	return value, env, nil
+}
+
+// parseDatabaseURL parses a database URL and checks that its scheme has a
+// driver. Errors never include the URL, since it may contain a password.
+func parseDatabaseURL(value, source string) (*url.URL, error) {
+	if value == "" {
+		return nil, fmt.Errorf("database URL in %s is empty", source)
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid database URL in %s: %s", source, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid database URL in %s: missing scheme, such as postgres://", source)
+	}
+	if _, err := dbmate.GetDriver(u.Scheme); err != nil {
+		return nil, fmt.Errorf("invalid database URL in %s: %s", source, err)
+	}
 
-	return url.Parse(value)
+	return u, nil
 }
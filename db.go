@@ -1,36 +1,82 @@
 package dbmate
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // DefaultMigrationsDir specifies default directory to find migration files
 var DefaultMigrationsDir = "./db/migrations"
 
+// DefaultSchemaFile specifies default location for the schema dump
+var DefaultSchemaFile = "./db/schema.sql"
+
+// DefaultMigrationsTable specifies the default name of the table which records
+// applied migrations
+var DefaultMigrationsTable = "schema_migrations"
+
 // DefaultProject specifies the default name to associate with the migrations
 var DefaultProject = "default"
 
+// DefaultLockTimeoutSecs specifies how long RecordOnly waits for the migration
+// lock
+var DefaultLockTimeoutSecs = 30
+
+// DefaultWaitInterval specifies the initial delay between attempts to connect
+// to the database while waiting for it
+var DefaultWaitInterval = time.Second
+
+// DefaultWaitTimeout specifies how long to wait for the database to accept
+// connections
+var DefaultWaitTimeout = 60 * time.Second
+
+// maxWaitInterval caps the delay between attempts to connect to the database
+var maxWaitInterval = 10 * time.Second
+
 // DB allows dbmate actions to be performed on a specified database
 type DB struct {
-	DatabaseURL   *url.URL
-	MigrationsDir string
-	Project       string
+	AllowChecksumMismatch bool
+	AutoDumpSchema        bool
+	DatabaseURL           *url.URL
+	DryRun                bool
+	FS                    fs.FS
+	Hooks                 Hooks
+	Logger                Logger
+	MigrationsDir         string
+	MigrationsTable       string
+	Project               string
+	SchemaFile            string
+	WaitBefore            bool
+	WaitInterval          time.Duration
+	WaitTimeout           time.Duration
 }
 
 // NewDB initializes a new dbmate database
 func NewDB(databaseURL *url.URL) *DB {
 	return &DB{
-		DatabaseURL:   databaseURL,
-		MigrationsDir: DefaultMigrationsDir,
-		Project:       DefaultProject,
+		DatabaseURL:     databaseURL,
+		Logger:          NewTextLogger(os.Stdout, LevelInfo),
+		MigrationsDir:   DefaultMigrationsDir,
+		MigrationsTable: DefaultMigrationsTable,
+		Project:         DefaultProject,
+		SchemaFile:      DefaultSchemaFile,
+		WaitInterval:    DefaultWaitInterval,
+		WaitTimeout:     DefaultWaitTimeout,
 	}
 }
 
@@ -39,8 +85,112 @@ func (db *DB) GetDriver() (Driver, error) {
 	return GetDriver(db.DatabaseURL.Scheme)
 }
 
+// log passes an event to the Logger, if there is one
+func (db *DB) log(e Event) {
+	if db.Logger == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	db.Logger.Log(e)
+}
+
+// logf logs an info level event with a formatted message
+func (db *DB) logf(name string, format string, args ...interface{}) {
+	db.log(Event{Level: LevelInfo, Name: name, Message: fmt.Sprintf(format, args...)})
+}
+
+// Wait blocks until the database server accepts connections, retrying with
+// an increasing delay for up to WaitTimeout
+func (db *DB) Wait() error {
+	return db.WaitContext(context.Background())
+}
+
+// WaitContext is like Wait, using ctx for database operations
+func (db *DB) WaitContext(ctx context.Context) error {
+	drv, err := db.GetDriver()
+	if err != nil {
+		return err
+	}
+
+	err = db.ping(ctx, drv)
+	if err == nil {
+		return nil
+	}
+
+	db.logf(EventWaiting, "Waiting for database")
+	deadline := time.Now().Add(db.WaitTimeout)
+	delay := db.WaitInterval
+	if delay <= 0 {
+		delay = DefaultWaitInterval
+	}
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+
+		db.log(Event{Level: LevelDebug, Name: EventWaitRetry, Err: err,
+			Message: fmt.Sprintf("Database not ready, retrying in %s: %s", delay.Round(time.Millisecond), err)})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if err = db.ping(ctx, drv); err == nil {
+			return nil
+		}
+
+		delay *= 2
+		if delay > maxWaitInterval {
+			delay = maxWaitInterval
+		}
+	}
+
+	return fmt.Errorf("unable to connect to database: %s", err)
+}
+
+// ping checks that the database server accepts connections
+func (db *DB) ping(ctx context.Context, drv Driver) error {
+	// the server is up, but the database hasn't been created yet
+	if exists, err := drv.DatabaseExists(ctx, db.DatabaseURL); err == nil && !exists {
+		return nil
+	}
+
+	sqlDB, err := drv.Open(db.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	return sqlDB.PingContext(ctx)
+}
+
+// waitIfRequested waits for the database if WaitBefore is set
+func (db *DB) waitIfRequested(ctx context.Context) error {
+	if !db.WaitBefore {
+		return nil
+	}
+
+	return db.WaitContext(ctx)
+}
+
 // Up creates the database (if necessary) and runs migrations
 func (db *DB) Up(lockTimeoutSecs int) error {
+	return db.UpContext(context.Background(), lockTimeoutSecs)
+}
+
+// UpContext is like Up, using ctx for database operations
+func (db *DB) UpContext(ctx context.Context, lockTimeoutSecs int) error {
+	if err := db.waitIfRequested(ctx); err != nil {
+		return err
+	}
+
 	drv, err := db.GetDriver()
 	if err != nil {
 		return err
@@ -49,41 +199,87 @@ func (db *DB) Up(lockTimeoutSecs int) error {
 	// create database if it does not already exist
 	// skip this step if we cannot determine status
 	// (e.g. user does not have list database permission)
-	exists, err := drv.DatabaseExists(db.DatabaseURL)
+	exists, err := drv.DatabaseExists(ctx, db.DatabaseURL)
 	if err == nil && !exists {
-		if err := drv.CreateDatabase(db.DatabaseURL); err != nil {
+		if db.DryRun {
+			return fmt.Errorf("can't dry run: database %s does not exist", databaseName(db.DatabaseURL))
+		}
+		if err := db.createDatabase(ctx, drv); err != nil {
 			return err
 		}
 	}
 
 	// migrate
-	return db.Migrate(lockTimeoutSecs)
+	return db.MigrateContext(ctx, lockTimeoutSecs)
 }
 
 // Create creates the current database
 func (db *DB) Create() error {
+	return db.CreateContext(context.Background())
+}
+
+// CreateContext is like Create, using ctx for database operations
+func (db *DB) CreateContext(ctx context.Context) error {
+	if db.DryRun {
+		return errDryRun("create")
+	}
+
+	if err := db.waitIfRequested(ctx); err != nil {
+		return err
+	}
+
 	drv, err := db.GetDriver()
 	if err != nil {
 		return err
 	}
 
-	return drv.CreateDatabase(db.DatabaseURL)
+	return db.createDatabase(ctx, drv)
+}
+
+// createDatabase logs and creates the current database
+func (db *DB) createDatabase(ctx context.Context, drv Driver) error {
+	db.logf(EventCreatingDatabase, "Creating: %s", databaseName(db.DatabaseURL))
+	return drv.CreateDatabase(ctx, db.DatabaseURL)
 }
 
 // Drop drops the current database (if it exists)
 func (db *DB) Drop() error {
+	return db.DropContext(context.Background())
+}
+
+// DropContext is like Drop, using ctx for database operations
+func (db *DB) DropContext(ctx context.Context) error {
+	if db.DryRun {
+		return errDryRun("drop")
+	}
+
+	if err := db.waitIfRequested(ctx); err != nil {
+		return err
+	}
+
 	drv, err := db.GetDriver()
 	if err != nil {
 		return err
 	}
 
-	return drv.DropDatabase(db.DatabaseURL)
+	db.logf(EventDroppingDatabase, "Dropping: %s", databaseName(db.DatabaseURL))
+	return drv.DropDatabase(ctx, db.DatabaseURL)
 }
 
-// RecordOnly will record without applying all unapplied filesystem migrations
+// RecordOnly will record without applying all unapplied filesystem migrations,
+// waiting up to DefaultLockTimeoutSecs for the migration lock
 func (db *DB) RecordOnly() error {
-	re := regexp.MustCompile(`^\d.*\.sql$`)
-	files, err := findMigrationFiles(db.MigrationsDir, re)
+	return db.RecordOnlyContext(context.Background(), DefaultLockTimeoutSecs)
+}
+
+// RecordOnlyContext is like RecordOnly, using ctx for database operations and
+// waiting up to lockTimeoutSecs for the migration lock
+func (db *DB) RecordOnlyContext(ctx context.Context, lockTimeoutSecs int) error {
+	if db.DryRun {
+		return errDryRun("record-only")
+	}
+
+	files, err := findMigrations(db.FS, db.MigrationsDir)
 	if err != nil {
 		return err
 	}
@@ -92,37 +288,47 @@ func (db *DB) RecordOnly() error {
 		return fmt.Errorf("no migration files found")
 	}
 
-	drv, sqlDB, err := db.openDatabaseForMigration()
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
 	if err != nil {
 		return err
 	}
 	defer mustClose(sqlDB)
 
-	if err := drv.Lock(sqlDB); err != nil {
-		return err
-	}
-	defer drv.Unlock(sqlDB)
+	recordFunc := func(drv Driver, sqlDB *sql.DB) error {
+		applied, err := drv.SelectMigrations(ctx, sqlDB, db.migrationsTable(), -1, db.Project)
+		if err != nil {
+			return err
+		}
 
-	applied, err := drv.SelectMigrations(sqlDB, -1, db.Project)
-	if err != nil {
-		return err
-	}
+		for _, filename := range files {
+			ver := migrationVersion(filename)
+			if ok := applied[ver]; ok {
+				continue
+			}
 
-	for _, filename := range files {
-		ver := migrationVersion(filename)
-		if ok := applied[ver]; ok {
-			continue
-		}
+			checksum, err := migrationFileChecksum(db.FS, db.MigrationsDir, filename)
+			if err != nil {
+				return err
+			}
 
-		err = doTransaction(sqlDB, func(tx Transaction) error {
-			if err := drv.InsertMigration(tx, ver, db.Project); err != nil {
+			err = doTransaction(ctx, sqlDB, func(tx Transaction) error {
+				return drv.InsertMigration(ctx, tx, db.migrationsTable(), MigrationRecord{
+					Version:     ver,
+					Project:     db.Project,
+					AppliedAt:   time.Now().UTC(),
+					ExecutionMs: -1,
+					Checksum:    checksum,
+				})
+			})
+			if err != nil {
 				return err
 			}
-			return nil
-		})
+		}
+
+		return nil
 	}
 
-	return nil
+	return db.runInLock(ctx, drv, sqlDB, lockTimeoutSecs, recordFunc)
 }
 
 const migrationTemplate = "-- migrate:up\n\n\n-- migrate:down\n\n"
@@ -143,7 +349,7 @@ func (db *DB) New(name string) error {
 
 	// check file does not already exist
 	path := filepath.Join(db.MigrationsDir, name)
-	fmt.Printf("Creating migration: %s\n", path)
+	db.logf(EventCreatingFile, "Creating migration: %s", path)
 
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		return fmt.Errorf("file already exists")
@@ -164,236 +370,1348 @@ func (db *DB) New(name string) error {
 	return nil
 }
 
-func doTransaction(db *sql.DB, txFunc func(Transaction) error) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+// schemaMigrationsHeader separates the schema from the applied migrations in
+// a schema file
+const schemaMigrationsHeader = "--\n-- Dbmate schema migrations\n--\n"
 
-	if err := txFunc(tx); err != nil {
-		if err1 := tx.Rollback(); err1 != nil {
-			return err1
-		}
+// DumpSchema writes the current database schema to SchemaFile, followed by
+// the migrations which have been applied for the current project
+func (db *DB) DumpSchema() error {
+	return db.DumpSchemaContext(context.Background())
+}
 
+// DumpSchemaContext is like DumpSchema, using ctx for database operations
+func (db *DB) DumpSchemaContext(ctx context.Context) error {
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
 		return err
 	}
+	defer mustClose(sqlDB)
 
-	return tx.Commit()
+	return db.dumpSchema(ctx, drv, sqlDB)
 }
 
-func (db *DB) openDatabaseForMigration() (Driver, *sql.DB, error) {
-	drv, err := db.GetDriver()
+func (db *DB) dumpSchema(ctx context.Context, drv Driver, sqlDB *sql.DB) error {
+	schema, err := drv.DumpSchema(ctx, db.DatabaseURL, sqlDB, db.migrationsTable())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	sqlDB, err := drv.Open(db.DatabaseURL)
+	applied, err := db.selectMigrations(ctx, drv, sqlDB, -1)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	if err := drv.CreateMigrationsTable(sqlDB); err != nil {
-		mustClose(sqlDB)
-		return nil, nil, err
+	versions := sortedVersions(applied)
+	if len(versions) > 0 {
+		values := make([]string, len(versions))
+		for i, ver := range versions {
+			values[i] = fmt.Sprintf("(%s, %s)", quoteLiteral(ver), quoteLiteral(db.Project))
+		}
+		schema = append(schema, fmt.Sprintf(
+			"%s\ninsert into %s (version, project) values\n    %s;\n",
+			schemaMigrationsHeader, db.quotedMigrationsTable(drv), strings.Join(values, ",\n    "))...)
 	}
 
-	return drv, sqlDB, nil
+	db.logf(EventWritingSchema, "Writing: %s", db.SchemaFile)
+
+	// create schema file dir if missing
+	dir := filepath.Dir(db.SchemaFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create directory `%s`", dir)
+	}
+
+	return ioutil.WriteFile(db.SchemaFile, schema, 0644)
 }
 
-// Migrate migrates database to the latest version
-func (db *DB) Migrate(lockTimeoutSecs int) error {
-	re := regexp.MustCompile(`^\d.*\.sql$`)
-	files, err := findMigrationFiles(db.MigrationsDir, re)
+// LoadSchema creates the database (if necessary) and loads SchemaFile into
+// it, recording the versions it lists as applied for the current project
+func (db *DB) LoadSchema() error {
+	return db.LoadSchemaContext(context.Background())
+}
+
+// LoadSchemaContext is like LoadSchema, using ctx for database operations
+func (db *DB) LoadSchemaContext(ctx context.Context) error {
+	if db.DryRun {
+		return errDryRun("load")
+	}
+
+	data, err := ioutil.ReadFile(db.SchemaFile)
 	if err != nil {
 		return err
 	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no migration files found")
+	// split the schema from the recorded migration versions
+	schema := string(data)
+	versions := []string{}
+	if i := strings.Index(schema, schemaMigrationsHeader); i >= 0 {
+		re := regexp.MustCompile(`\('(\d+)',`)
+		for _, match := range re.FindAllStringSubmatch(schema[i:], -1) {
+			versions = append(versions, match[1])
+		}
+		schema = schema[:i]
+	}
+
+	if err := db.waitIfRequested(ctx); err != nil {
+		return err
 	}
 
-	drv, sqlDB, err := db.openDatabaseForMigration()
+	drv, err := db.GetDriver()
 	if err != nil {
 		return err
 	}
-	defer mustClose(sqlDB)
 
-	return RunInLock(drv, sqlDB, lockTimeoutSecs, func(driver Driver, sqlDB *sql.DB) error {
-		alreadyApplied, err := driver.SelectMigrations(sqlDB, -1, db.Project)
-		if err != nil {
+	// create database if it does not already exist
+	exists, err := drv.DatabaseExists(ctx, db.DatabaseURL)
+	if err == nil && !exists {
+		if err := db.createDatabase(ctx, drv); err != nil {
 			return err
 		}
+	}
 
-		for _, filename := range files {
-			ver := migrationVersion(filename)
-			if ok := alreadyApplied[ver]; ok {
-				continue
-			}
-			fmt.Printf("Applying: %s\n", filename)
-			migration, err := parseMigration(filepath.Join(db.MigrationsDir, filename))
-			if err != nil {
-				return err
-			}
+	checksums, err := db.schemaMigrationChecksums()
+	if err != nil {
+		return err
+	}
 
-			// begin transaction
-			err = doTransaction(sqlDB, func(tx Transaction) error {
-				// run actual migration
-				if _, err := tx.Exec(migration["up"]); err != nil {
-					return err
-				}
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
 
-				// record migration
-				if err := drv.InsertMigration(tx, ver, db.Project); err != nil {
-					return err
-				}
+	db.logf(EventLoadingSchema, "Loading: %s", db.SchemaFile)
 
-				return nil
-			})
-			if err != nil {
+	return doTransaction(ctx, sqlDB, func(tx Transaction) error {
+		if strings.TrimSpace(schema) != "" {
+			if _, err := tx.ExecContext(ctx, schema); err != nil {
+				return err
+			}
+		}
+
+		for _, ver := range versions {
+			record := MigrationRecord{
+				Version:     ver,
+				Project:     db.Project,
+				AppliedAt:   time.Now().UTC(),
+				ExecutionMs: -1,
+				Checksum:    checksums[ver],
+			}
+			if err := drv.InsertMigration(ctx, tx, db.migrationsTable(), record); err != nil {
 				return err
 			}
 		}
+
 		return nil
 	})
 }
 
-func findMigrationFiles(dir string, re *regexp.Regexp) ([]string, error) {
-	files, err := ioutil.ReadDir(dir)
+// schemaMigrationChecksums returns the checksums of the SQL migration files in
+// MigrationsDir, keyed by version, so that versions recorded by LoadSchema can
+// be verified later. A schema file may be loaded without any migrations
+// directory, in which case nothing is returned.
+func (db *DB) schemaMigrationChecksums() (map[string]string, error) {
+	checksums := map[string]string{}
+	if _, err := readDir(db.FS, db.MigrationsDir); errors.Is(err, fs.ErrNotExist) {
+		return checksums, nil
+	}
+
+	re := regexp.MustCompile(`^\d.*\.sql$`)
+	files, err := findMigrationFiles(db.FS, db.MigrationsDir, re)
 	if err != nil {
-		return nil, fmt.Errorf("could not find migrations directory `%s`", dir)
+		return nil, err
 	}
 
-	matches := []string{}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	for _, filename := range files {
+		checksum, err := migrationChecksum(db.FS, filepath.Join(db.MigrationsDir, filename))
+		if err != nil {
+			return nil, err
 		}
+		checksums[migrationVersion(filename)] = checksum
+	}
 
-		name := file.Name()
-		if !re.MatchString(name) {
-			continue
-		}
+	return checksums, nil
+}
 
-		matches = append(matches, name)
+func doTransaction(ctx context.Context, db *sql.DB, txFunc func(Transaction) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
 
-	sort.Strings(matches)
+	if err := txFunc(tx); err != nil {
+		// the transaction has already been rolled back if ctx was cancelled
+		if err1 := tx.Rollback(); err1 != nil && err1 != sql.ErrTxDone {
+			return err1
+		}
 
-	return matches, nil
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func findMigrationFile(dir string, ver string) (string, error) {
-	if ver == "" {
-		panic("migration version is required")
+func (db *DB) openDatabaseForMigration(ctx context.Context) (Driver, *sql.DB, error) {
+	if err := checkMigrationsTable(db.migrationsTable()); err != nil {
+		return nil, nil, err
 	}
 
-	ver = regexp.QuoteMeta(ver)
-	re := regexp.MustCompile(fmt.Sprintf(`^%s.*\.sql$`, ver))
+	if err := db.waitIfRequested(ctx); err != nil {
+		return nil, nil, err
+	}
 
-	files, err := findMigrationFiles(dir, re)
+	drv, err := db.GetDriver()
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
-	if len(files) == 0 {
-		return "", fmt.Errorf("can't find migration file: %s*.sql", ver)
+	sqlDB, err := drv.Open(db.DatabaseURL)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return files[0], nil
-}
+	// dry runs must not write to the database
+	if db.DryRun {
+		return drv, sqlDB, nil
+	}
 
-func migrationVersion(filename string) string {
-	return regexp.MustCompile(`^\d+`).FindString(filename)
+	if err := drv.CreateMigrationsTable(ctx, sqlDB, db.migrationsTable()); err != nil {
+		mustClose(sqlDB)
+		return nil, nil, err
+	}
+
+	return drv, sqlDB, nil
 }
 
-// parseMigration reads a migration file into a map with up/down keys
-// implementation is similar to regexp.Split()
-func parseMigration(path string) (map[string]string, error) {
-	// read migration file into string
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+// migrationsTable returns the name of the migrations table, which is
+// DefaultMigrationsTable if MigrationsTable isn't set
+func (db *DB) migrationsTable() string {
+	if db.MigrationsTable == "" {
+		return DefaultMigrationsTable
 	}
-	contents := string(data)
 
-	// split string on our trigger comment
-	separatorRegexp := regexp.MustCompile(`(?m)^-- migrate:(.*)$`)
-	matches := separatorRegexp.FindAllStringSubmatchIndex(contents, -1)
+	return db.MigrationsTable
+}
 
-	migrations := map[string]string{}
-	direction := ""
-	beg := 0
-	end := 0
+// checkMigrationsTable checks that the migrations table is a table name,
+// optionally qualified with a schema
+func checkMigrationsTable(table string) error {
+	schema, name := splitTableName(table)
+	if name == "" || strings.Contains(schema, ".") || (schema == "" && table != name) {
+		return fmt.Errorf("invalid migrations table: %q (expected table or schema.table)", table)
+	}
 
-	for _, match := range matches {
-		end = match[0]
-		if direction != "" {
-			// write previous direction to output map
-			migrations[direction] = contents[beg:end]
-		}
+	return nil
+}
 
-		// each match records the start of a new direction
-		direction = contents[match[2]:match[3]]
-		beg = match[1]
+// quotedMigrationsTable returns the migrations table name, quoted by the
+// driver if it knows how
+func (db *DB) quotedMigrationsTable(drv Driver) string {
+	if quoter, ok := drv.(tableQuoter); ok {
+		return quoter.quoteTable(db.migrationsTable())
 	}
 
-	// write final direction to output map
-	migrations[direction] = contents[beg:]
-
-	return migrations, nil
+	return db.migrationsTable()
 }
 
-// Rollback rolls back the most recent migration
-func (db *DB) Rollback() error {
-	drv, sqlDB, err := db.openDatabaseForMigration()
+// hasMigrationsColumn reports whether the migrations table has a column. It is
+// used during dry runs, which don't upgrade a table created by an earlier
+// version of dbmate.
+func (db *DB) hasMigrationsColumn(ctx context.Context, drv Driver, sqlDB *sql.DB, column string) bool {
+	rows, err := sqlDB.QueryContext(ctx, fmt.Sprintf("select %s from %s where 1 = 0",
+		column, db.quotedMigrationsTable(drv)))
 	if err != nil {
-		return err
+		return false
 	}
-	defer mustClose(sqlDB)
+	mustClose(rows)
 
-	applied, err := drv.SelectMigrations(sqlDB, 1, db.Project)
-	if err != nil {
-		return err
+	return true
+}
+
+// selectLegacyMigrations returns the versions recorded in a migrations table
+// which predates projects. Once upgraded, every version it lists belongs to
+// the default project.
+func (db *DB) selectLegacyMigrations(ctx context.Context, drv Driver, sqlDB *sql.DB) ([]string, error) {
+	versions := []string{}
+	if db.Project != DefaultProject {
+		return versions, nil
+	}
+
+	rows, err := sqlDB.QueryContext(ctx, fmt.Sprintf("select version from %s order by version",
+		db.quotedMigrationsTable(drv)))
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
+
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+// selectMigrations returns applied migrations for the current project. During
+// a dry run the migrations table may not exist yet, in which case nothing has
+// been applied, or may not have been upgraded yet.
+func (db *DB) selectMigrations(ctx context.Context, drv Driver, sqlDB *sql.DB, limit int) (map[string]bool, error) {
+	if db.DryRun {
+		exists, err := drv.MigrationsTableExists(ctx, sqlDB, db.migrationsTable())
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return map[string]bool{}, nil
+		}
+
+		if !db.hasMigrationsColumn(ctx, drv, sqlDB, "project") {
+			versions, err := db.selectLegacyMigrations(ctx, drv, sqlDB)
+			if err != nil {
+				return nil, err
+			}
+
+			// like SelectMigrations, the limit counts back from the latest
+			if limit >= 0 && limit < len(versions) {
+				versions = versions[len(versions)-limit:]
+			}
+			applied := map[string]bool{}
+			for _, ver := range versions {
+				applied[ver] = true
+			}
+
+			return applied, nil
+		}
+	}
+
+	return drv.SelectMigrations(ctx, sqlDB, db.migrationsTable(), limit, db.Project)
+}
+
+// selectMigrationRecords returns the details of applied migrations for the
+// current project, allowing for a missing or not yet upgraded migrations
+// table during a dry run. Details which the table doesn't record are left
+// empty, as they are for migrations applied before an upgrade.
+func (db *DB) selectMigrationRecords(ctx context.Context, drv Driver, sqlDB *sql.DB) ([]MigrationRecord, error) {
+	if db.DryRun {
+		exists, err := drv.MigrationsTableExists(ctx, sqlDB, db.migrationsTable())
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return []MigrationRecord{}, nil
+		}
+
+		if !db.hasMigrationsColumn(ctx, drv, sqlDB, "checksum") {
+			applied, err := db.selectMigrations(ctx, drv, sqlDB, -1)
+			if err != nil {
+				return nil, err
+			}
+
+			records := []MigrationRecord{}
+			for _, ver := range sortedVersions(applied) {
+				records = append(records, MigrationRecord{Version: ver, Project: db.Project, ExecutionMs: -1})
+			}
+
+			return records, nil
+		}
+	}
+
+	return drv.SelectMigrationRecords(ctx, sqlDB, db.migrationsTable(), db.Project)
+}
+
+// runInLock runs lockFunc in the migration lock for the current database and
+// project, logging when the lock is acquired and released
+func (db *DB) runInLock(ctx context.Context, drv Driver, sqlDB *sql.DB, lockTimeoutSecs int,
+	lockFunc func(Driver, *sql.DB) error) error {
+	name := lockName(db.DatabaseURL, db.Project)
+	acquired := false
+	err := RunInLock(ctx, drv, sqlDB, name, lockTimeoutSecs, func(drv Driver, sqlDB *sql.DB) error {
+		acquired = true
+		db.log(Event{Level: LevelDebug, Name: EventLockAcquired, Message: "Acquired lock: " + name})
+		return lockFunc(drv, sqlDB)
+	})
+	if acquired {
+		db.log(Event{Level: LevelDebug, Name: EventLockReleased, Message: "Released lock: " + name})
+	}
+
+	return err
+}
+
+// errDryRun is returned by actions which cannot be previewed with a dry run
+func errDryRun(action string) error {
+	return fmt.Errorf("%s is not supported with dry run", action)
+}
+
+// dryRunSQL formats the SQL a migration section would execute, followed by
+// the change it would make to the migrations table
+func dryRunSQL(direction string, section migrationSection, effect string) string {
+	if section.Func != nil {
+		return fmt.Sprintf("-- migrate:%s\n-- (Go migration)\n-- %s", direction, effect)
 	}
 
-	// grab most recent applied migration (applied has len=1)
-	latest := ""
-	for ver := range applied {
-		latest = ver
+	options := ""
+	if !section.Transaction() {
+		options += " transaction:false"
 	}
-	if latest == "" {
-		return fmt.Errorf("can't rollback: no migrations have been applied")
+	if !section.Split() {
+		options += " split:false"
+	}
+
+	return fmt.Sprintf("-- migrate:%s%s\n%s\n-- %s",
+		direction, options, strings.TrimSpace(section.Contents), effect)
+}
+
+// Migrate migrates database to the latest version
+func (db *DB) Migrate(lockTimeoutSecs int) error {
+	return db.MigrateContext(context.Background(), lockTimeoutSecs)
+}
+
+// MigrateContext is like Migrate, using ctx for database operations
+func (db *DB) MigrateContext(ctx context.Context, lockTimeoutSecs int) error {
+	return db.migrate(ctx, lockTimeoutSecs, "")
+}
+
+// MigrateTo applies pending migrations up to and including the given version
+func (db *DB) MigrateTo(lockTimeoutSecs int, version string) error {
+	return db.MigrateToContext(context.Background(), lockTimeoutSecs, version)
+}
+
+// MigrateToContext is like MigrateTo, using ctx for database operations
+func (db *DB) MigrateToContext(ctx context.Context, lockTimeoutSecs int, version string) error {
+	if version == "" {
+		return fmt.Errorf("can't migrate: target version is required")
 	}
 
-	filename, err := findMigrationFile(db.MigrationsDir, latest)
+	return db.migrate(ctx, lockTimeoutSecs, version)
+}
+
+// migrate applies pending migrations, stopping after target unless it is empty
+func (db *DB) migrate(ctx context.Context, lockTimeoutSecs int, target string) error {
+	files, err := findMigrations(db.FS, db.MigrationsDir)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Rolling back: %s\n", filename)
+	if len(files) == 0 {
+		return fmt.Errorf("no migration files found")
+	}
+
+	if target != "" {
+		found := false
+		for _, filename := range files {
+			if migrationVersion(filename) == target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("can't migrate to %s: migration file not found", target)
+		}
+	}
 
-	migration, err := parseMigration(filepath.Join(db.MigrationsDir, filename))
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
 	if err != nil {
 		return err
 	}
+	defer mustClose(sqlDB)
+
+	migrateFunc := func(driver Driver, sqlDB *sql.DB) error {
+		if !db.AllowChecksumMismatch {
+			if err := db.verify(ctx, driver, sqlDB); err != nil {
+				return err
+			}
+		}
 
-	// begin transaction
-	err = doTransaction(sqlDB, func(tx Transaction) error {
-		// rollback migration
-		if _, err := tx.Exec(migration["down"]); err != nil {
+		alreadyApplied, err := db.selectMigrations(ctx, driver, sqlDB, -1)
+		if err != nil {
 			return err
 		}
 
-		// remove migration record
-		if err := drv.DeleteMigration(tx, latest); err != nil {
+		pending := []string{}
+		for _, filename := range files {
+			ver := migrationVersion(filename)
+			if target != "" && ver > target {
+				break
+			}
+			if ok := alreadyApplied[ver]; !ok {
+				pending = append(pending, filename)
+			}
+		}
+
+		if db.DryRun {
+			return db.printPendingMigrations(pending)
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if err := db.applyMigrations(ctx, driver, sqlDB, pending); err != nil {
 			return err
 		}
 
+		if db.AutoDumpSchema {
+			return db.dumpSchema(ctx, driver, sqlDB)
+		}
+
 		return nil
+	}
+
+	// dry runs only read from the database, so don't need the lock
+	if db.DryRun {
+		return migrateFunc(drv, sqlDB)
+	}
+
+	return db.runInLock(ctx, drv, sqlDB, lockTimeoutSecs, migrateFunc)
+}
+
+// printPendingMigrations logs the SQL each pending migration would execute
+func (db *DB) printPendingMigrations(files []string) error {
+	for _, filename := range files {
+		migration, err := loadMigration(db.FS, db.MigrationsDir, filename)
+		if err != nil {
+			return err
+		}
+
+		ver := migrationVersion(filename)
+		db.log(Event{Level: LevelInfo, Name: EventWouldApply, Message: "Would apply: " + filename,
+			Version: ver, Filename: filename,
+			SQL: dryRunSQL("up", migration["up"], fmt.Sprintf(
+				"insert into %s: version %s, project %s", db.migrationsTable(), ver, db.Project))})
+	}
+
+	return nil
+}
+
+// applyMigrations applies each migration in turn, calling the migrate hooks
+// around the run
+func (db *DB) applyMigrations(ctx context.Context, drv Driver, sqlDB *sql.DB, files []string) error {
+	if err := db.Hooks.beforeMigrate(ctx); err != nil {
+		return err
+	}
+
+	applied := []string{}
+	var err error
+	for _, filename := range files {
+		if err = db.applyMigration(ctx, drv, sqlDB, filename); err != nil {
+			break
+		}
+		applied = append(applied, migrationVersion(filename))
+	}
+
+	return db.afterHook(err, db.Hooks.afterMigrate(ctx, applied, err))
+}
+
+// applyMigration applies a single migration and records it, calling the
+// BeforeEach and AfterEach hooks around it
+func (db *DB) applyMigration(ctx context.Context, drv Driver, sqlDB *sql.DB, filename string) error {
+	ver := migrationVersion(filename)
+	migration, err := loadMigration(db.FS, db.MigrationsDir, filename)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := migrationFileChecksum(db.FS, db.MigrationsDir, filename)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Hooks.beforeEach(ctx, ver); err != nil {
+		return err
+	}
+
+	db.log(Event{Level: LevelInfo, Name: EventApplying, Message: "Applying: " + filename,
+		Version: ver, Filename: filename})
+
+	// run actual migration, then record it
+	start := time.Now()
+	err = execMigrationSection(ctx, drv, sqlDB, filename, "up", migration["up"], func(tx Transaction) error {
+		return drv.InsertMigration(ctx, tx, db.migrationsTable(), MigrationRecord{
+			Version:     ver,
+			Project:     db.Project,
+			AppliedAt:   start.UTC(),
+			ExecutionMs: int64(time.Since(start) / time.Millisecond),
+			Checksum:    checksum,
+		})
 	})
+	elapsed := time.Since(start)
+	if err == nil {
+		db.log(Event{Level: LevelInfo, Name: EventApplied,
+			Message: fmt.Sprintf("Applied: %s in %s", filename, elapsed.Round(time.Millisecond)),
+			Version: ver, Filename: filename, Duration: elapsed})
+	}
+
+	return db.afterHook(err, db.Hooks.afterEach(ctx, ver, elapsed, err))
+}
+
+// Verify checks that no applied migration file has been edited since it was
+// applied, by comparing its checksum with the one recorded in the database
+func (db *DB) Verify() error {
+	return db.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, using ctx for database operations
+func (db *DB) VerifyContext(ctx context.Context) error {
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	return db.verify(ctx, drv, sqlDB)
+}
+
+func (db *DB) verify(ctx context.Context, drv Driver, sqlDB *sql.DB) error {
+	changed, err := db.changedMigrations(ctx, drv, sqlDB)
 	if err != nil {
 		return err
 	}
 
+	if len(changed) > 0 {
+		files := []string{}
+		for _, c := range changed {
+			files = append(files, c.filename)
+		}
+
+		return fmt.Errorf("checksum mismatch: applied migrations have changed on disk: %s",
+			strings.Join(files, ", "))
+	}
+
 	return nil
 }
+
+// Repair records the current checksum of every applied migration file which
+// has changed since it was applied, so that it passes verification again
+func (db *DB) Repair() error {
+	return db.RepairContext(context.Background())
+}
+
+// RepairContext is like Repair, using ctx for database operations
+func (db *DB) RepairContext(ctx context.Context) error {
+	if db.DryRun {
+		return errDryRun("repair")
+	}
+
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	changed, err := db.changedMigrations(ctx, drv, sqlDB)
+	if err != nil {
+		return err
+	}
+
+	return doTransaction(ctx, sqlDB, func(tx Transaction) error {
+		for _, c := range changed {
+			db.log(Event{Level: LevelInfo, Name: EventRepairing, Message: "Repairing: " + c.filename,
+				Version: c.version, Filename: c.filename})
+			if err := drv.UpdateMigrationChecksum(ctx, tx, db.migrationsTable(), c.version, db.Project, c.checksum); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// changedMigration is an applied migration whose file no longer matches the
+// checksum recorded when it was applied
+type changedMigration struct {
+	version  string
+	filename string
+	checksum string
+}
+
+// changedMigrations compares applied migrations with the files on disk.
+// Migrations without a recorded checksum, or without a file, are skipped.
+func (db *DB) changedMigrations(ctx context.Context, drv Driver, sqlDB *sql.DB) ([]changedMigration, error) {
+	records, err := db.selectMigrationRecords(ctx, drv, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	re := regexp.MustCompile(`^\d.*\.sql$`)
+	files, err := findMigrationFiles(db.FS, db.MigrationsDir, re)
+	if err != nil {
+		return nil, err
+	}
+
+	onDisk := map[string]string{}
+	for _, filename := range files {
+		onDisk[migrationVersion(filename)] = filename
+	}
+
+	changed := []changedMigration{}
+	for _, record := range records {
+		filename, ok := onDisk[record.Version]
+		if !ok || record.Checksum == "" {
+			continue
+		}
+
+		checksum, err := migrationChecksum(db.FS, filepath.Join(db.MigrationsDir, filename))
+		if err != nil {
+			return nil, err
+		}
+
+		if checksum != record.Checksum {
+			changed = append(changed, changedMigration{record.Version, filename, checksum})
+		}
+	}
+
+	return changed, nil
+}
+
+// MigrationState describes whether a migration has been applied to the database
+type MigrationState string
+
+const (
+	// MigrationApplied is a migration file which has been applied
+	MigrationApplied MigrationState = "applied"
+	// MigrationPending is a migration file which has not yet been applied
+	MigrationPending MigrationState = "pending"
+	// MigrationMissing is an applied migration with no matching file on disk
+	MigrationMissing MigrationState = "missing"
+)
+
+// MigrationStatus describes the state of a single migration version, along
+// with the details recorded when it was applied
+type MigrationStatus struct {
+	Version     string
+	Filename    string
+	State       MigrationState
+	AppliedAt   time.Time
+	ExecutionMs int64
+	Checksum    string
+}
+
+// Status lists every migration found on disk or recorded in the database
+// for the current project, in ascending version order
+func (db *DB) Status() ([]MigrationStatus, error) {
+	return db.StatusContext(context.Background())
+}
+
+// StatusContext is like Status, using ctx for database operations
+func (db *DB) StatusContext(ctx context.Context) ([]MigrationStatus, error) {
+	files, err := findMigrations(db.FS, db.MigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(sqlDB)
+
+	records, err := db.selectMigrationRecords(ctx, drv, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[string]MigrationRecord{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	statuses := []MigrationStatus{}
+	onDisk := map[string]bool{}
+	for _, filename := range files {
+		ver := migrationVersion(filename)
+		onDisk[ver] = true
+
+		status := MigrationStatus{Version: ver, Filename: filename, State: MigrationPending}
+		if record, ok := applied[ver]; ok {
+			status.State = MigrationApplied
+			status.AppliedAt = record.AppliedAt
+			status.ExecutionMs = record.ExecutionMs
+			status.Checksum = record.Checksum
+		}
+		statuses = append(statuses, status)
+	}
+
+	for _, record := range records {
+		if !onDisk[record.Version] {
+			statuses = append(statuses, MigrationStatus{
+				Version:     record.Version,
+				State:       MigrationMissing,
+				AppliedAt:   record.AppliedAt,
+				ExecutionMs: record.ExecutionMs,
+				Checksum:    record.Checksum,
+			})
+		}
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// findMigrationFiles lists the files in dir matching re, reading from fsys if
+// it is not nil
+func findMigrationFiles(fsys fs.FS, dir string, re *regexp.Regexp) ([]string, error) {
+	files, err := readDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not find migrations directory `%s`", dir)
+	}
+
+	matches := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		name := file.Name()
+		if !re.MatchString(name) {
+			continue
+		}
+
+		matches = append(matches, name)
+	}
+
+	sort.Strings(matches)
+
+	return matches, nil
+}
+
+func findMigrationFile(fsys fs.FS, dir string, ver string) (string, error) {
+	if ver == "" {
+		panic("migration version is required")
+	}
+
+	if m, ok := registeredMigration(ver); ok {
+		return m.filename(), nil
+	}
+
+	ver = regexp.QuoteMeta(ver)
+	re := regexp.MustCompile(fmt.Sprintf(`^%s.*\.sql$`, ver))
+
+	files, err := findMigrationFiles(fsys, dir, re)
+	if err != nil {
+		return "", err
+	}
+
+	if len(files) == 0 {
+		return "", fmt.Errorf("can't find migration file: %s*.sql", ver)
+	}
+
+	return files[0], nil
+}
+
+// findMigrations returns the SQL migration files in dir, along with the file
+// names of any registered Go migrations, in version order
+func findMigrations(fsys fs.FS, dir string) ([]string, error) {
+	re := regexp.MustCompile(`^\d.*\.sql$`)
+	files, err := findMigrationFiles(fsys, dir, re)
+	if err != nil {
+		return nil, err
+	}
+
+	onDisk := map[string]string{}
+	for _, filename := range files {
+		onDisk[migrationVersion(filename)] = filename
+	}
+
+	for _, m := range registeredMigrations() {
+		if filename, ok := onDisk[m.version]; ok {
+			return nil, fmt.Errorf("migration %s is registered in Go and also exists as %s",
+				m.version, filename)
+		}
+		files = append(files, m.filename())
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// loadMigration returns the sections of a migration, which is either a
+// registered Go migration or a SQL file in dir
+func loadMigration(fsys fs.FS, dir, filename string) (map[string]migrationSection, error) {
+	if m, ok := registeredMigration(migrationVersion(filename)); ok && m.filename() == filename {
+		return m.sections(), nil
+	}
+
+	return parseMigration(fsys, filepath.Join(dir, filename))
+}
+
+func migrationVersion(filename string) string {
+	return regexp.MustCompile(`^\d+`).FindString(filename)
+}
+
+// migrationSection holds the SQL for one direction of a migration, along with
+// any options given on its `-- migrate:` line (e.g. `transaction:false`) and
+// the line of the file on which Contents starts. For Go migrations, Func is
+// run instead.
+type migrationSection struct {
+	Contents string
+	Options  map[string]string
+	Line     int
+	Func     MigrationFunc
+}
+
+// Transaction reports whether the section should run inside a transaction
+func (s migrationSection) Transaction() bool {
+	return s.Options["transaction"] != "false"
+}
+
+// Split reports whether the section should be split into statements, rather
+// than executed in one call
+func (s migrationSection) Split() bool {
+	return s.Options["split"] != "false"
+}
+
+// position returns the line of the file and the column of a byte offset in
+// the section's contents
+func (s migrationSection) position(offset int) (int, int) {
+	before := s.Contents[:offset]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+
+	return s.Line + strings.Count(before, "\n"), utf8.RuneCountInString(before[lineStart:]) + 1
+}
+
+// migrationOptionValues lists the options accepted on a `-- migrate:` line,
+// along with their allowed values
+var migrationOptionValues = map[string][]string{
+	"split":       {"true", "false"},
+	"transaction": {"true", "false"},
+}
+
+// parseMigrationOptions parses space separated key:value options
+func parseMigrationOptions(direction, str string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, field := range strings.Fields(str) {
+		parts := strings.SplitN(field, ":", 2)
+		allowed, ok := migrationOptionValues[parts[0]]
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid option for migrate:%s: %s", direction, field)
+		}
+
+		valid := false
+		for _, v := range allowed {
+			valid = valid || v == parts[1]
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid value for migrate:%s option %s: %s (expected %s)",
+				direction, parts[0], parts[1], strings.Join(allowed, " or "))
+		}
+
+		options[parts[0]] = parts[1]
+	}
+
+	return options, nil
+}
+
+// migrationFileChecksum returns the checksum of a migration file in dir. Go
+// migrations have no file to check, so their checksum is empty.
+func migrationFileChecksum(fsys fs.FS, dir, filename string) (string, error) {
+	if m, ok := registeredMigration(migrationVersion(filename)); ok && m.filename() == filename {
+		return "", nil
+	}
+
+	return migrationChecksum(fsys, filepath.Join(dir, filename))
+}
+
+// migrationChecksum returns the hex encoded SHA-256 checksum of a migration file
+func migrationChecksum(fsys fs.FS, path string) (string, error) {
+	data, err := readFile(fsys, path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// parseMigration reads a migration file into a map with up/down keys
+// implementation is similar to regexp.Split()
+func parseMigration(fsys fs.FS, path string) (map[string]migrationSection, error) {
+	// read migration file into string
+	data, err := readFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	contents := string(data)
+
+	// split string on our trigger comment
+	separatorRegexp := regexp.MustCompile(`(?m)^-- migrate:(\S*)(.*)$`)
+	matches := separatorRegexp.FindAllStringSubmatchIndex(contents, -1)
+
+	migrations := map[string]migrationSection{}
+	direction := ""
+	options := map[string]string{}
+	beg := 0
+	end := 0
+
+	// lineAt returns the line of the file containing contents[i]
+	lineAt := func(i int) int {
+		return strings.Count(contents[:i], "\n") + 1
+	}
+
+	for _, match := range matches {
+		end = match[0]
+		if direction != "" {
+			// write previous direction to output map
+			migrations[direction] = migrationSection{Contents: contents[beg:end], Options: options,
+				Line: lineAt(beg)}
+		}
+
+		// each match records the start of a new direction
+		direction = contents[match[2]:match[3]]
+		options, err = parseMigrationOptions(direction, contents[match[4]:match[5]])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(path), err)
+		}
+		beg = match[1]
+	}
+
+	// write final direction to output map
+	migrations[direction] = migrationSection{Contents: contents[beg:], Options: options, Line: lineAt(beg)}
+
+	return migrations, nil
+}
+
+// execMigrationSection runs a migration section inside a transaction (unless
+// the section has opted out with `transaction:false`), followed by recordFunc.
+// Errors are returned as a *MigrationError.
+func execMigrationSection(ctx context.Context, drv Driver, sqlDB *sql.DB, filename string, direction string,
+	section migrationSection, recordFunc func(Transaction) error) error {
+	var err error
+	switch {
+	case section.Func != nil:
+		err = doTransaction(ctx, sqlDB, func(tx Transaction) error {
+			if err := section.Func(ctx, tx); err != nil {
+				return err
+			}
+
+			return recordFunc(tx)
+		})
+	case !section.Transaction():
+		if err = execStatements(ctx, drv, sqlDB, section); err == nil {
+			err = recordFunc(sqlDB)
+		}
+	default:
+		err = doTransaction(ctx, sqlDB, func(tx Transaction) error {
+			if err := execStatements(ctx, drv, tx, section); err != nil {
+				return err
+			}
+
+			return recordFunc(tx)
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	migErr, ok := err.(*MigrationError)
+	if !ok {
+		migErr = &MigrationError{Err: err}
+	}
+	migErr.Version = migrationVersion(filename)
+	migErr.Filename = filename
+	migErr.Direction = direction
+
+	return migErr
+}
+
+// execStatements executes each statement in a migration section in turn, so
+// drivers don't need to support multiple statements in one call, or the whole
+// section at once if it has opted out with `split:false`. Errors report which
+// statement failed, and where in the file, as a *MigrationError.
+func execStatements(ctx context.Context, drv Driver, tx Transaction, section migrationSection) error {
+	code := strings.TrimLeftFunc(section.Contents, unicode.IsSpace)
+	statements := []sqlStatement{{SQL: section.Contents,
+		Line: strings.Count(section.Contents[:len(section.Contents)-len(code)], "\n") + 1}}
+	if section.Split() {
+		dialect := sqlDialect{}
+		if d, ok := drv.(dialectDriver); ok {
+			dialect = d.sqlDialect()
+		}
+		statements = splitStatements(section.Contents, dialect)
+	}
+
+	locator, canLocate := drv.(errorLocator)
+	for i, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt.SQL); err != nil {
+			migErr := &MigrationError{Statement: i + 1, Line: section.Line + stmt.Line - 1, Err: err}
+			if canLocate {
+				if offset, ok := locator.errorOffset(err, stmt.SQL); ok {
+					migErr.Line, migErr.Column = section.position(stmt.Offset + offset)
+				}
+			}
+
+			return migErr
+		}
+	}
+
+	return nil
+}
+
+// Rollback rolls back the most recent migration, waiting up to
+// DefaultLockTimeoutSecs for the migration lock
+func (db *DB) Rollback() error {
+	return db.RollbackContext(context.Background(), DefaultLockTimeoutSecs)
+}
+
+// RollbackContext is like Rollback, using ctx for database operations and
+// waiting up to lockTimeoutSecs for the migration lock
+func (db *DB) RollbackContext(ctx context.Context, lockTimeoutSecs int) error {
+	return db.RollbackStepsContext(ctx, lockTimeoutSecs, 1)
+}
+
+// RollbackSteps rolls back the given number of most recent migrations,
+// newest first, waiting up to DefaultLockTimeoutSecs for the migration lock
+func (db *DB) RollbackSteps(steps int) error {
+	return db.RollbackStepsContext(context.Background(), DefaultLockTimeoutSecs, steps)
+}
+
+// RollbackStepsContext is like RollbackSteps, using ctx for database operations
+// and waiting up to lockTimeoutSecs for the migration lock
+func (db *DB) RollbackStepsContext(ctx context.Context, lockTimeoutSecs int, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("can't rollback: steps must be at least 1")
+	}
+
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	rollbackFunc := func(driver Driver, sqlDB *sql.DB) error {
+		applied, err := db.selectMigrations(ctx, driver, sqlDB, steps)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return fmt.Errorf("can't rollback: no migrations have been applied")
+		}
+
+		return db.rollbackVersions(ctx, driver, sqlDB, reverseStrings(sortedVersions(applied)))
+	}
+
+	return db.runRollbackInLock(ctx, drv, sqlDB, lockTimeoutSecs, rollbackFunc)
+}
+
+// RollbackTo rolls back every migration applied after the given version,
+// newest first, leaving the given version as the most recent. It waits up to
+// DefaultLockTimeoutSecs for the migration lock.
+func (db *DB) RollbackTo(version string) error {
+	return db.RollbackToContext(context.Background(), DefaultLockTimeoutSecs, version)
+}
+
+// RollbackToContext is like RollbackTo, using ctx for database operations and
+// waiting up to lockTimeoutSecs for the migration lock
+func (db *DB) RollbackToContext(ctx context.Context, lockTimeoutSecs int, version string) error {
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	rollbackFunc := func(driver Driver, sqlDB *sql.DB) error {
+		applied, err := db.selectMigrations(ctx, driver, sqlDB, -1)
+		if err != nil {
+			return err
+		}
+		if !applied[version] {
+			return fmt.Errorf("can't rollback to %s: version has not been applied", version)
+		}
+
+		versions := []string{}
+		for _, ver := range reverseStrings(sortedVersions(applied)) {
+			if ver == version {
+				break
+			}
+			versions = append(versions, ver)
+		}
+
+		return db.rollbackVersions(ctx, driver, sqlDB, versions)
+	}
+
+	return db.runRollbackInLock(ctx, drv, sqlDB, lockTimeoutSecs, rollbackFunc)
+}
+
+// runRollbackInLock runs rollbackFunc in the migration lock, so that the
+// versions it reads can't be changed by another process before they're
+// rolled back. Dry runs only read from the database, so don't need the lock.
+func (db *DB) runRollbackInLock(ctx context.Context, drv Driver, sqlDB *sql.DB, lockTimeoutSecs int,
+	rollbackFunc func(Driver, *sql.DB) error) error {
+	if db.DryRun {
+		return rollbackFunc(drv, sqlDB)
+	}
+
+	return db.runInLock(ctx, drv, sqlDB, lockTimeoutSecs, rollbackFunc)
+}
+
+// Redo rolls back the most recent migration and applies it again, holding the
+// migration lock throughout
+func (db *DB) Redo(lockTimeoutSecs int) error {
+	return db.RedoContext(context.Background(), lockTimeoutSecs)
+}
+
+// RedoContext is like Redo, using ctx for database operations
+func (db *DB) RedoContext(ctx context.Context, lockTimeoutSecs int) error {
+	return db.RedoStepsContext(ctx, lockTimeoutSecs, 1)
+}
+
+// RedoSteps rolls back the given number of most recent migrations, newest
+// first, then applies them again, oldest first
+func (db *DB) RedoSteps(lockTimeoutSecs int, steps int) error {
+	return db.RedoStepsContext(context.Background(), lockTimeoutSecs, steps)
+}
+
+// RedoStepsContext is like RedoSteps, using ctx for database operations
+func (db *DB) RedoStepsContext(ctx context.Context, lockTimeoutSecs int, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("can't redo: steps must be at least 1")
+	}
+
+	drv, sqlDB, err := db.openDatabaseForMigration(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(sqlDB)
+
+	redoFunc := func(driver Driver, sqlDB *sql.DB) error {
+		applied, err := db.selectMigrations(ctx, driver, sqlDB, steps)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return fmt.Errorf("can't redo: no migrations have been applied")
+		}
+
+		// find every file first, so a missing one fails before anything is
+		// rolled back
+		versions := sortedVersions(applied)
+		files := []string{}
+		for _, ver := range versions {
+			filename, err := findMigrationFile(db.FS, db.MigrationsDir, ver)
+			if err != nil {
+				return err
+			}
+			files = append(files, filename)
+		}
+
+		if err := db.revertVersions(ctx, driver, sqlDB, reverseStrings(versions)); err != nil {
+			return err
+		}
+
+		if db.DryRun {
+			return db.printPendingMigrations(files)
+		}
+
+		if err := db.applyMigrations(ctx, driver, sqlDB, files); err != nil {
+			return err
+		}
+
+		if db.AutoDumpSchema {
+			return db.dumpSchema(ctx, driver, sqlDB)
+		}
+
+		return nil
+	}
+
+	// dry runs only read from the database, so don't need the lock
+	if db.DryRun {
+		return redoFunc(drv, sqlDB)
+	}
+
+	return db.runInLock(ctx, drv, sqlDB, lockTimeoutSecs, redoFunc)
+}
+
+// rollbackVersions rolls back each version in turn, then writes the schema
+// file if requested
+func (db *DB) rollbackVersions(ctx context.Context, drv Driver, sqlDB *sql.DB, versions []string) error {
+	if err := db.revertVersions(ctx, drv, sqlDB, versions); err != nil {
+		return err
+	}
+
+	if db.AutoDumpSchema && !db.DryRun {
+		return db.dumpSchema(ctx, drv, sqlDB)
+	}
+
+	return nil
+}
+
+// revertVersions rolls back each version in turn, each in its own
+// transaction, stopping at the first failure
+func (db *DB) revertVersions(ctx context.Context, drv Driver, sqlDB *sql.DB, versions []string) error {
+	reverted := []string{}
+	for _, ver := range versions {
+		if err := db.rollbackVersion(ctx, drv, sqlDB, ver); err != nil {
+			if len(reverted) == 0 {
+				return err
+			}
+
+			return fmt.Errorf("rolled back %s before failing on %s: %w",
+				strings.Join(reverted, ", "), ver, err)
+		}
+		reverted = append(reverted, ver)
+	}
+
+	return nil
+}
+
+func (db *DB) rollbackVersion(ctx context.Context, drv Driver, sqlDB *sql.DB, ver string) error {
+	filename, err := findMigrationFile(db.FS, db.MigrationsDir, ver)
+	if err != nil {
+		return err
+	}
+
+	migration, err := loadMigration(db.FS, db.MigrationsDir, filename)
+	if err != nil {
+		return err
+	}
+
+	if db.DryRun {
+		db.log(Event{Level: LevelInfo, Name: EventWouldRollBack, Message: "Would roll back: " + filename,
+			Version: ver, Filename: filename,
+			SQL: dryRunSQL("down", migration["down"], fmt.Sprintf(
+				"delete from %s: version %s, project %s", db.migrationsTable(), ver, db.Project))})
+		return nil
+	}
+
+	db.log(Event{Level: LevelInfo, Name: EventRollingBack, Message: "Rolling back: " + filename,
+		Version: ver, Filename: filename})
+
+	// rollback migration, then remove its record
+	start := time.Now()
+	err = execMigrationSection(ctx, drv, sqlDB, filename, "down", migration["down"], func(tx Transaction) error {
+		return drv.DeleteMigration(ctx, tx, db.migrationsTable(), ver, db.Project)
+	})
+	elapsed := time.Since(start)
+	if err == nil {
+		db.log(Event{Level: LevelInfo, Name: EventRolledBack,
+			Message: fmt.Sprintf("Rolled back: %s in %s", filename, elapsed.Round(time.Millisecond)),
+			Version: ver, Filename: filename, Duration: elapsed})
+	}
+
+	return db.afterHook(err, db.Hooks.onRollback(ctx, ver, elapsed, err))
+}
+
+// sortedVersions returns the versions in a set in ascending order
+func sortedVersions(set map[string]bool) []string {
+	versions := []string{}
+	for ver := range set {
+		versions = append(versions, ver)
+	}
+	sort.Strings(versions)
+
+	return versions
+}
+
+// reverseStrings reverses a slice in place and returns it
+func reverseStrings(s []string) []string {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+
+	return s
+}
@@ -1,65 +1,196 @@
 package dbmate
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
 )
 
-// Driver provides top level database functions
+// Driver provides top level database functions. The string following the
+// *sql.DB or Transaction in the migrations table methods is the name of the
+// migrations table, which may be qualified with a schema (e.g.
+// ops.schema_migrations) and is quoted by the driver.
 type Driver interface {
 	Open(*url.URL) (*sql.DB, error)
-	DatabaseExists(*url.URL) (bool, error)
-	CreateDatabase(*url.URL) error
-	DropDatabase(*url.URL) error
-	CreateMigrationsTable(*sql.DB) error
-	SelectMigrations(*sql.DB, int, string) (map[string]bool, error)
-	InsertMigration(Transaction, string, string) error
-	DeleteMigration(Transaction, string) error
-	Lock(*sql.DB) error
-	Unlock(*sql.DB)
+	DatabaseExists(context.Context, *url.URL) (bool, error)
+	CreateDatabase(context.Context, *url.URL) error
+	DropDatabase(context.Context, *url.URL) error
+	MigrationsTableExists(context.Context, *sql.DB, string) (bool, error)
+	CreateMigrationsTable(context.Context, *sql.DB, string) error
+	SelectMigrations(context.Context, *sql.DB, string, int, string) (map[string]bool, error)
+	SelectMigrationRecords(context.Context, *sql.DB, string, string) ([]MigrationRecord, error)
+	InsertMigration(context.Context, Transaction, string, MigrationRecord) error
+	UpdateMigrationChecksum(context.Context, Transaction, string, string, string, string) error
+	DeleteMigration(context.Context, Transaction, string, string, string) error
+	DumpSchema(context.Context, *url.URL, *sql.DB, string) ([]byte, error)
+	Lock(context.Context, *sql.Conn, string) error
+	Unlock(context.Context, *sql.Conn, string) error
 }
 
-// Transaction can represent a database or open transaction
+// MigrationRecord describes an applied migration, as stored in the
+// schema_migrations table. Migrations applied before these details were
+// recorded have a zero AppliedAt and an empty Checksum. ExecutionMs is -1
+// when the migration wasn't run by dbmate (e.g. it was recorded by load or
+// record-only), and is stored as NULL.
+type MigrationRecord struct {
+	Version     string
+	Project     string
+	AppliedAt   time.Time
+	ExecutionMs int64
+	Checksum    string
+}
+
+// tableQuoter is implemented by drivers which can quote the migrations table
+// name for the schema file
+type tableQuoter interface {
+	quoteTable(table string) string
+}
+
+// Transaction can represent a database, connection or open transaction
 type Transaction interface {
-	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
-// RunInLock will execute a function in the context of the driver's advisory lock
-func RunInLock(driver Driver, sqlDB *sql.DB, timeoutSecs int, lockFunc func(Driver, *sql.DB) error) error {
-	lockChan := make(chan string, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		if err := driver.Lock(sqlDB); err != nil {
-			errChan <- err
-		} else {
-			lockChan <- "acquired"
+// RunInLock will execute a function in the context of the driver's migration
+// lock. The lock is taken and released on a single connection, which is held
+// until lockFunc returns. If the lock can't be acquired within timeoutSecs, the
+// driver stops waiting and an error is returned.
+func RunInLock(ctx context.Context, driver Driver, sqlDB *sql.DB, name string, timeoutSecs int, lockFunc func(Driver, *sql.DB) error) error {
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer mustClose(conn)
+
+	lockCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(timeoutSecs))
+	defer cancel()
+	if err := driver.Lock(lockCtx, conn, name); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return errLockTimeout(timeoutSecs)
 		}
-	}()
+		return err
+	}
+
+	err = lockFunc(driver, sqlDB)
+
+	// release the lock even if ctx has been cancelled
+	if unlockErr := driver.Unlock(context.Background(), conn, name); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// lockName returns the name of the migration lock for a database and project
+func lockName(u *url.URL, project string) string {
+	return fmt.Sprintf("dbmate:%s:%s", databaseName(u), project)
+}
+
+func errLockTimeout(timeoutSecs int) error {
+	return fmt.Errorf("Timeout waiting for database migration lock (waited %v seconds)", timeoutSecs)
+}
+
+// lockRetryInterval is how often drivers which poll for a lock try again
+var lockRetryInterval = 100 * time.Millisecond
+
+// waitToRetryLock waits before the next attempt to take a lock, and returns the
+// context's error if it is done first
+func waitToRetryLock(ctx context.Context) error {
 	select {
-	case <-lockChan:
-		defer driver.Unlock(sqlDB)
-		return lockFunc(driver, sqlDB)
-	case err := <-errChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(lockRetryInterval):
+		return nil
+	}
+}
+
+// migrationsColumn is a column added to the migrations table after it was
+// first released, along with the definition used to add it
+type migrationsColumn struct {
+	name       string
+	definition string
+}
+
+// addMigrationsColumns adds any of the given columns which don't already exist
+// to the migrations table, whose name must already be quoted
+func addMigrationsColumns(ctx context.Context, db *sql.DB, table string, columns []migrationsColumn) error {
+	for _, col := range columns {
+		probe := fmt.Sprintf("select %s from %s limit 1", col.name, table)
+		if _, err := db.ExecContext(ctx, probe); err == nil {
+			continue
+		}
+
+		_, err := db.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s %s",
+			table, col.name, col.definition))
+		if err != nil {
+			// another process may have added the column in the meantime
+			if _, probeErr := db.ExecContext(ctx, probe); probeErr == nil {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgradeMigrationsPrimaryKey replaces a primary key on version alone, as
+// created by earlier versions of dbmate, with one on (project, version), so
+// that projects sharing the migrations table can apply the same version.
+// keyColumns returns the number of columns in the current primary key.
+func upgradeMigrationsPrimaryKey(keyColumns func() (int, error), upgrade func() error) error {
+	columns, err := keyColumns()
+	if err != nil || columns != 1 {
 		return err
-	case <-time.After(time.Second * time.Duration(timeoutSecs)):
-		return fmt.Errorf("Timeout waiting for database migration lock (waited %v seconds)", timeoutSecs)
 	}
+
+	if err := upgrade(); err != nil {
+		// another process may have upgraded it in the meantime
+		if columns, probeErr := keyColumns(); probeErr == nil && columns == 2 {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]func() Driver{}
+)
+
+// RegisterDriver makes a database driver available for URLs with the given
+// scheme. The built in drivers register themselves, and registering a scheme
+// again replaces its driver, so library users can add their own schemes or
+// override existing ones.
+func RegisterDriver(scheme string, factory func() Driver) {
+	if factory == nil {
+		panic("dbmate: RegisterDriver factory is nil")
+	}
+
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	drivers[scheme] = factory
 }
 
 // GetDriver loads a database driver by name
 func GetDriver(name string) (Driver, error) {
-	switch name {
-	case "mysql":
-		return MySQLDriver{}, nil
-	case "postgres", "postgresql":
-		return PostgresDriver{}, nil
-	case "sqlite", "sqlite3":
-		return SQLiteDriver{}, nil
-	default:
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+
+	if !ok {
 		return nil, fmt.Errorf("unknown driver: %s", name)
 	}
+
+	return factory(), nil
 }
 
 // GetDriverOpen is a shortcut for GetDriver(u.Scheme).Open(u)
@@ -1,27 +1,53 @@
 package dbmate
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestGetDriver_Postgres(t *testing.T) {
-	drv, err := GetDriver("postgres")
-	require.Nil(t, err)
-	_, ok := drv.(PostgresDriver)
-	require.Equal(t, true, ok)
+func TestGetDriver_Error(t *testing.T) {
+	drv, err := GetDriver("foo")
+	require.Equal(t, "unknown driver: foo", err.Error())
+	require.Nil(t, drv)
 }
 
-func TestGetDriver_MySQL(t *testing.T) {
-	drv, err := GetDriver("mysql")
+type testDriver struct {
+	Driver
+}
+
+func TestRegisterDriver(t *testing.T) {
+	RegisterDriver("foo", func() Driver { return testDriver{} })
+	defer delete(drivers, "foo")
+
+	drv, err := GetDriver("foo")
 	require.Nil(t, err)
-	_, ok := drv.(MySQLDriver)
+	_, ok := drv.(testDriver)
 	require.Equal(t, true, ok)
 }
 
-func TestGetDriver_Error(t *testing.T) {
-	drv, err := GetDriver("foo")
-	require.Equal(t, "unknown driver: foo", err.Error())
-	require.Nil(t, drv)
+// timeoutDriver fails to take a lock with an error wrapping the deadline
+type timeoutDriver struct {
+	Driver
+}
+
+func (drv timeoutDriver) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	<-ctx.Done()
+	return fmt.Errorf("waiting for lock: %w", ctx.Err())
+}
+
+func TestRunInLock_Timeout(t *testing.T) {
+	u := testURL(t)
+	drv, err := GetDriver(u.Scheme)
+	require.Nil(t, err)
+	sqlDB, err := drv.Open(u)
+	require.Nil(t, err)
+	defer mustClose(sqlDB)
+
+	err = RunInLock(context.Background(), timeoutDriver{drv}, sqlDB, "dbmate:test", 1,
+		func(Driver, *sql.DB) error { return nil })
+	require.Equal(t, errLockTimeout(1), err)
 }
@@ -0,0 +1,45 @@
+package dbmate
+
+import (
+	"fmt"
+)
+
+// MigrationError is returned when a migration fails to apply or roll back.
+// Statement is the position of the failing statement in the section, and Line
+// is the line of the migration file it starts on, or the line of the error
+// itself when the driver reports where it occurred, in which case Column is
+// also set. Each is zero when it isn't known, for example for Go migrations.
+type MigrationError struct {
+	Version   string
+	Filename  string
+	Direction string
+	Statement int
+	Line      int
+	Column    int
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	switch {
+	case e.Column > 0:
+		return fmt.Sprintf("%s: statement %d at line %d, column %d: %s",
+			e.Filename, e.Statement, e.Line, e.Column, e.Err)
+	case e.Line > 0:
+		return fmt.Sprintf("%s: statement %d at line %d: %s", e.Filename, e.Statement, e.Line, e.Err)
+	default:
+		return fmt.Sprintf("%s: %s", e.Filename, e.Err)
+	}
+}
+
+// Unwrap returns the underlying error
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// errorLocator is implemented by drivers which can tell where in a statement
+// an error occurred
+type errorLocator interface {
+	// errorOffset returns the byte offset in stmt of the position reported by
+	// err, if there is one
+	errorOffset(err error, stmt string) (int, bool)
+}
@@ -0,0 +1,36 @@
+package dbmate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationError(t *testing.T) {
+	inner := errors.New("syntax error")
+	err := &MigrationError{Version: "1", Filename: "1_test.sql", Direction: "up", Err: inner}
+	require.EqualError(t, err, "1_test.sql: syntax error")
+	require.True(t, errors.Is(err, inner))
+
+	err.Statement = 2
+	err.Line = 5
+	require.EqualError(t, err, "1_test.sql: statement 2 at line 5: syntax error")
+
+	err.Column = 3
+	require.EqualError(t, err, "1_test.sql: statement 2 at line 5, column 3: syntax error")
+}
+
+func TestMigrationSectionPosition(t *testing.T) {
+	section := migrationSection{Contents: "\ncreate table t1 (\n  é integer, nmae\n)", Line: 3}
+
+	line, column := section.position(0)
+	require.Equal(t, 3, line)
+	require.Equal(t, 1, column)
+
+	// columns count characters, not bytes
+	line, column = section.position(33)
+	require.Equal(t, "nmae", section.Contents[33:37])
+	require.Equal(t, 5, line)
+	require.Equal(t, 14, column)
+}
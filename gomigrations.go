@@ -0,0 +1,99 @@
+package dbmate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// MigrationFunc applies or reverts a migration written in Go. It runs inside
+// the same transaction that records the migration in schema_migrations.
+type MigrationFunc func(ctx context.Context, tx Transaction) error
+
+// goMigration is a migration written in Go, registered with RegisterMigration
+type goMigration struct {
+	version string
+	name    string
+	up      MigrationFunc
+	down    MigrationFunc
+}
+
+// filename is used in place of a file name when listing or printing a Go
+// migration, and sorts alongside the SQL migration files
+func (m goMigration) filename() string {
+	if m.name == "" {
+		return m.version + ".go"
+	}
+
+	return fmt.Sprintf("%s_%s.go", m.version, m.name)
+}
+
+var (
+	goMigrationsMu sync.Mutex
+	goMigrations   = map[string]goMigration{}
+)
+
+// RegisterMigration registers a migration written in Go, which is applied and
+// rolled back in version order along with the SQL migration files, and
+// recorded in schema_migrations in the same way. The down function may be nil
+// if the migration can't be rolled back. RegisterMigration is usually called
+// from an init function, and panics if the version is invalid or has already
+// been registered.
+func RegisterMigration(version, name string, up, down MigrationFunc) {
+	if !regexp.MustCompile(`^\d+$`).MatchString(version) {
+		panic(fmt.Sprintf("dbmate: invalid migration version %q", version))
+	}
+	if up == nil {
+		panic(fmt.Sprintf("dbmate: migration %s has no up function", version))
+	}
+
+	goMigrationsMu.Lock()
+	defer goMigrationsMu.Unlock()
+
+	if _, ok := goMigrations[version]; ok {
+		panic(fmt.Sprintf("dbmate: migration %s registered twice", version))
+	}
+	goMigrations[version] = goMigration{version: version, name: name, up: up, down: down}
+}
+
+// registeredMigration returns the Go migration registered for a version
+func registeredMigration(version string) (goMigration, bool) {
+	goMigrationsMu.Lock()
+	defer goMigrationsMu.Unlock()
+
+	m, ok := goMigrations[version]
+	return m, ok
+}
+
+// registeredMigrations returns every registered Go migration, in version order
+func registeredMigrations() []goMigration {
+	goMigrationsMu.Lock()
+	defer goMigrationsMu.Unlock()
+
+	migrations := []goMigration{}
+	for _, m := range goMigrations {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].filename() < migrations[j].filename()
+	})
+
+	return migrations
+}
+
+// sections returns the up and down sections for a Go migration
+func (m goMigration) sections() map[string]migrationSection {
+	down := m.down
+	if down == nil {
+		down = func(context.Context, Transaction) error {
+			return fmt.Errorf("can't be rolled back: no down function was registered")
+		}
+	}
+
+	return map[string]migrationSection{
+		"up":   {Func: m.up},
+		"down": {Func: down},
+	}
+}
@@ -0,0 +1,95 @@
+package dbmate
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Hooks are functions which DB calls around migrations, for example to notify
+// a deploy system or take a backup. Any of them may be nil, and none of them
+// are called for dry runs.
+type Hooks struct {
+	// BeforeMigrate is called by Migrate, once it holds the migration lock,
+	// before applying any pending migrations. It isn't called when there is
+	// nothing to apply. Returning an error stops the run.
+	BeforeMigrate func(ctx context.Context) error
+
+	// AfterMigrate is called at the end of a run with the versions which were
+	// applied, and the error which stopped the run, if any
+	AfterMigrate func(ctx context.Context, applied []string, err error) error
+
+	// BeforeEach is called before each migration is applied. Returning an
+	// error stops the run before that migration.
+	BeforeEach func(ctx context.Context, version string) error
+
+	// AfterEach is called after each migration is applied, or fails
+	AfterEach func(ctx context.Context, version string, duration time.Duration, err error) error
+
+	// OnRollback is called after each migration is rolled back, or fails to be
+	OnRollback func(ctx context.Context, version string, duration time.Duration, err error) error
+}
+
+func (h Hooks) beforeMigrate(ctx context.Context) error {
+	if h.BeforeMigrate == nil {
+		return nil
+	}
+
+	return hookError("BeforeMigrate", h.BeforeMigrate(ctx))
+}
+
+func (h Hooks) afterMigrate(ctx context.Context, applied []string, err error) error {
+	if h.AfterMigrate == nil {
+		return nil
+	}
+
+	return hookError("AfterMigrate", h.AfterMigrate(ctx, applied, err))
+}
+
+func (h Hooks) beforeEach(ctx context.Context, version string) error {
+	if h.BeforeEach == nil {
+		return nil
+	}
+
+	return hookError("BeforeEach", h.BeforeEach(ctx, version))
+}
+
+func (h Hooks) afterEach(ctx context.Context, version string, duration time.Duration, err error) error {
+	if h.AfterEach == nil {
+		return nil
+	}
+
+	return hookError("AfterEach", h.AfterEach(ctx, version, duration, err))
+}
+
+func (h Hooks) onRollback(ctx context.Context, version string, duration time.Duration, err error) error {
+	if h.OnRollback == nil {
+		return nil
+	}
+
+	return hookError("OnRollback", h.OnRollback(ctx, version, duration, err))
+}
+
+// hookError adds the name of the hook to an error it returned
+func hookError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%s hook failed: %s", name, err)
+}
+
+// afterHook combines the error from a step with the error from the hook which
+// followed it. The step's error takes precedence, so a hook failing after a
+// failed step is only logged.
+func (db *DB) afterHook(err error, hookErr error) error {
+	if hookErr == nil {
+		return err
+	}
+	if err == nil {
+		return hookErr
+	}
+
+	db.log(Event{Level: LevelWarn, Name: EventHookFailed, Message: hookErr.Error(), Err: hookErr})
+	return err
+}
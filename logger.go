@@ -0,0 +1,163 @@
+package dbmate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a logged event
+type LogLevel int
+
+// Log levels, from least to most severe
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the level with the given name (debug, info, warn or error)
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("invalid log level: %s (expected one of %s)",
+		name, strings.Join(logLevelNames, ", "))
+}
+
+// Event names passed to a Logger
+const (
+	EventDatabaseURL      = "database_url"
+	EventWaiting          = "waiting"
+	EventWaitRetry        = "wait_retry"
+	EventCreatingDatabase = "creating_database"
+	EventDroppingDatabase = "dropping_database"
+	EventCreatingFile     = "creating_migration"
+	EventLockAcquired     = "lock_acquired"
+	EventLockReleased     = "lock_released"
+	EventApplying         = "applying"
+	EventApplied          = "applied"
+	EventWouldApply       = "would_apply"
+	EventRollingBack      = "rolling_back"
+	EventRolledBack       = "rolled_back"
+	EventWouldRollBack    = "would_roll_back"
+	EventRepairing        = "repairing"
+	EventWritingSchema    = "writing_schema"
+	EventLoadingSchema    = "loading_schema"
+	EventHookFailed       = "hook_failed"
+)
+
+// Event is something which happened while running a dbmate command. Message
+// is a human readable description; the other fields are set where relevant.
+type Event struct {
+	Time     time.Time
+	Level    LogLevel
+	Name     string
+	Message  string
+	Version  string
+	Filename string
+	Duration time.Duration
+	SQL      string
+	Err      error
+}
+
+// Logger receives the events produced by DB methods
+type Logger interface {
+	Log(Event)
+}
+
+// textLogger writes the message of each event as a line of text
+type textLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+// NewTextLogger returns a Logger which writes the message of each event at or
+// above level to w, followed by its SQL (for dry runs)
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+func (l *textLogger) Log(e Event) {
+	if e.Level < l.level {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Fprintln(l.w, e.Message)
+	if e.SQL != "" {
+		fmt.Fprintf(l.w, "%s\n\n", e.SQL)
+	}
+}
+
+// jsonLogger writes each event as a JSON object on its own line
+type jsonLogger struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	level LogLevel
+}
+
+// jsonEvent is the JSON encoding of an Event
+type jsonEvent struct {
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	Event      string  `json:"event"`
+	Message    string  `json:"message"`
+	Version    string  `json:"version,omitempty"`
+	Filename   string  `json:"filename,omitempty"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	SQL        string  `json:"sql,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// NewJSONLogger returns a Logger which writes each event at or above level to
+// w as a JSON object on its own line
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &jsonLogger{enc: json.NewEncoder(w), level: level}
+}
+
+func (l *jsonLogger) Log(e Event) {
+	if e.Level < l.level {
+		return
+	}
+
+	je := jsonEvent{
+		Time:       e.Time.UTC().Format(time.RFC3339Nano),
+		Level:      e.Level.String(),
+		Event:      e.Name,
+		Message:    e.Message,
+		Version:    e.Version,
+		Filename:   e.Filename,
+		DurationMs: float64(e.Duration) / float64(time.Millisecond),
+		SQL:        e.SQL,
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// there's nowhere to report a failure to write a log
+	_ = l.enc.Encode(je)
+}
@@ -0,0 +1,57 @@
+package dbmate
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("debug")
+	require.Nil(t, err)
+	require.Equal(t, LevelDebug, level)
+
+	level, err = ParseLogLevel("WARN")
+	require.Nil(t, err)
+	require.Equal(t, LevelWarn, level)
+
+	_, err = ParseLogLevel("verbose")
+	require.Equal(t, "invalid log level: verbose (expected one of debug, info, warn, error)", err.Error())
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo)
+
+	logger.Log(Event{Level: LevelDebug, Name: EventLockAcquired, Message: "Acquired lock: foo"})
+	logger.Log(Event{Level: LevelInfo, Name: EventApplying, Message: "Applying: 1_foo.sql"})
+	logger.Log(Event{Level: LevelInfo, Name: EventWouldApply, Message: "Would apply: 1_foo.sql",
+		SQL: "-- migrate:up\ncreate table foo (id int);"})
+
+	require.Equal(t, "Applying: 1_foo.sql\n"+
+		"Would apply: 1_foo.sql\n-- migrate:up\ncreate table foo (id int);\n\n", buf.String())
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LevelInfo)
+
+	logger.Log(Event{Level: LevelDebug, Name: EventLockAcquired, Message: "Acquired lock: foo"})
+	logger.Log(Event{
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:    LevelError,
+		Name:     EventApplied,
+		Message:  "Applied: 1_foo.sql in 2ms",
+		Version:  "1",
+		Filename: "1_foo.sql",
+		Duration: 1500 * time.Microsecond,
+		Err:      errors.New("boom"),
+	})
+
+	require.Equal(t, `{"time":"2020-01-02T03:04:05Z","level":"error","event":"applied",`+
+		`"message":"Applied: 1_foo.sql in 2ms","version":"1","filename":"1_foo.sql",`+
+		`"duration_ms":1.5,"error":"boom"}`+"\n", buf.String())
+}
@@ -1,18 +1,30 @@
+//go:build !nomysql
+// +build !nomysql
+
 package dbmate
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"database/sql"
 	"fmt"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 
-	_ "github.com/go-sql-driver/mysql" // mysql driver for database/sql
+	"github.com/go-sql-driver/mysql"
 )
 
 // MySQLDriver provides top level database functions
 type MySQLDriver struct {
 }
 
+func init() {
+	RegisterDriver("mysql", func() Driver { return MySQLDriver{} })
+}
+
 func normalizeMySQLURL(u *url.URL) string {
 	normalizedURL := *u
 	normalizedURL.Scheme = ""
@@ -47,49 +59,62 @@ func (drv MySQLDriver) openRootDB(u *url.URL) (*sql.DB, error) {
 }
 
 func quoteIdentifier(str string) string {
-	str = strings.Replace(str, "`", "\\`", -1)
+	str = strings.Replace(str, "`", "``", -1)
 
 	return fmt.Sprintf("`%s`", str)
 }
 
+// mySQLQuoteTable quotes a table name, which may be qualified with a database
+func mySQLQuoteTable(table string) string {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return quoteIdentifier(name)
+	}
+
+	return quoteIdentifier(schema) + "." + quoteIdentifier(name)
+}
+
+func (drv MySQLDriver) quoteTable(table string) string {
+	return mySQLQuoteTable(table)
+}
+
+func (drv MySQLDriver) sqlDialect() sqlDialect {
+	return sqlDialect{BackslashEscapes: true, HashComments: true}
+}
+
 // CreateDatabase creates the specified database
-func (drv MySQLDriver) CreateDatabase(u *url.URL) error {
+func (drv MySQLDriver) CreateDatabase(ctx context.Context, u *url.URL) error {
 	name := databaseName(u)
-	fmt.Printf("Creating: %s\n", name)
-
 	db, err := drv.openRootDB(u)
 	if err != nil {
 		return err
 	}
 	defer mustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("create database %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("create database %s",
 		quoteIdentifier(name)))
 
 	return err
 }
 
 // DropDatabase drops the specified database (if it exists)
-func (drv MySQLDriver) DropDatabase(u *url.URL) error {
+func (drv MySQLDriver) DropDatabase(ctx context.Context, u *url.URL) error {
 	name := databaseName(u)
-	fmt.Printf("Dropping: %s\n", name)
-
 	db, err := drv.openRootDB(u)
 	if err != nil {
 		return err
 	}
 	defer mustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("drop database if exists %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("drop database if exists %s",
 		quoteIdentifier(name)))
 
 	return err
 }
 
 // DatabaseExists determines whether the database exists
-func (drv MySQLDriver) DatabaseExists(u *url.URL) (bool, error) {
+func (drv MySQLDriver) DatabaseExists(ctx context.Context, u *url.URL) (bool, error) {
 	name := databaseName(u)
-
 	db, err := drv.openRootDB(u)
 	if err != nil {
 		return false, err
@@ -97,7 +122,7 @@ func (drv MySQLDriver) DatabaseExists(u *url.URL) (bool, error) {
 	defer mustClose(db)
 
 	exists := false
-	err = db.QueryRow(`select true from information_schema.schemata
+	err = db.QueryRowContext(ctx, `select true from information_schema.schemata
 		where schema_name = ?`, name).Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -106,32 +131,73 @@ func (drv MySQLDriver) DatabaseExists(u *url.URL) (bool, error) {
 	return exists, err
 }
 
-// CreateMigrationsTable creates the schema_migrations table
-func (drv MySQLDriver) CreateMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(`create table if not exists schema_migrations (
-		version varchar(255) primary key)`)
+// MigrationsTableExists determines whether the migrations table exists
+func (drv MySQLDriver) MigrationsTableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	exists := false
+	err := db.QueryRowContext(ctx, `select true from information_schema.tables
+		where table_schema = coalesce(nullif(?, ''), database()) and table_name = ?`,
+		schema, name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return exists, err
+}
+
+// CreateMigrationsTable creates the migrations table
+func (drv MySQLDriver) CreateMigrationsTable(ctx context.Context, db *sql.DB, table string) error {
+	quoted := mySQLQuoteTable(table)
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+		version varchar(255) not null,
+		project varchar(255) not null default 'default',
+		primary key (project, version))`, quoted))
 	if err != nil {
 		return err
 	}
 
-	// Add the project column if it doesn't already exist.
-	_, err = db.Exec(`select project from schema_migrations limit 1`)
+	// add any columns introduced since the table was first created
+	err = addMigrationsColumns(ctx, db, quoted, []migrationsColumn{
+		{"project", "varchar(255) default 'default'"},
+		{"applied_at", "datetime"},
+		{"execution_ms", "bigint"},
+		{"checksum", "varchar(64)"},
+	})
 	if err != nil {
-		_, err = db.Exec(`alter table schema_migrations
-			add column project varchar(255) default 'default'`)
+		return err
 	}
 
-	return err
+	schema, name := splitTableName(table)
+	keyColumns := func() (columns int, err error) {
+		err = db.QueryRowContext(ctx, `select count(*) from information_schema.key_column_usage
+			where table_schema = coalesce(nullif(?, ''), database()) and table_name = ?
+			and constraint_name = 'PRIMARY'`, schema, name).Scan(&columns)
+		return columns, err
+	}
+
+	return upgradeMigrationsPrimaryKey(keyColumns, func() error {
+		_, err := db.ExecContext(ctx, fmt.Sprintf(
+			"update %s set project = 'default' where project is null", quoted))
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`alter table %s
+			modify project varchar(255) not null default 'default',
+			drop primary key, add primary key (project, version)`, quoted))
+		return err
+	})
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
-func (drv MySQLDriver) SelectMigrations(db *sql.DB, limit int, project string) (map[string]bool, error) {
-	query := "select version from schema_migrations where project = ? order by version desc"
+func (drv MySQLDriver) SelectMigrations(ctx context.Context, db *sql.DB, table string, limit int, project string) (map[string]bool, error) {
+	query := fmt.Sprintf("select version from %s where project = ? order by version desc",
+		mySQLQuoteTable(table))
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query, project)
+	rows, err := db.QueryContext(ctx, query, project)
 	if err != nil {
 		return nil, err
 	}
@@ -151,26 +217,313 @@ func (drv MySQLDriver) SelectMigrations(db *sql.DB, limit int, project string) (
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the details of every applied migration
+// for a project, in ascending version order
+func (drv MySQLDriver) SelectMigrationRecords(ctx context.Context, db *sql.DB, table string, project string) ([]MigrationRecord, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`select version, project, applied_at, execution_ms, checksum
+		from %s where project = ? order by version`, mySQLQuoteTable(table)), project)
+	if err != nil {
+		return nil, err
+	}
+
+	defer mustClose(rows)
+
+	records := []MigrationRecord{}
+	for rows.Next() {
+		var record MigrationRecord
+		var appliedAt mysql.NullTime
+		var executionMs sql.NullInt64
+		var checksum sql.NullString
+		if err := rows.Scan(&record.Version, &record.Project, &appliedAt, &executionMs, &checksum); err != nil {
+			return nil, err
+		}
+
+		record.AppliedAt = appliedAt.Time
+		record.ExecutionMs = -1
+		if executionMs.Valid {
+			record.ExecutionMs = executionMs.Int64
+		}
+		record.Checksum = checksum.String
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
 // InsertMigration adds a new migration record
-func (drv MySQLDriver) InsertMigration(db Transaction, version string, project string) error {
-	_, err := db.Exec("insert into schema_migrations (version, project) values (?, ?)", version, project)
+func (drv MySQLDriver) InsertMigration(ctx context.Context, db Transaction, table string, record MigrationRecord) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`insert into %s
+		(version, project, applied_at, execution_ms, checksum) values (?, ?, ?, ?, ?)`,
+		mySQLQuoteTable(table)),
+		record.Version, record.Project, nullTime(record.AppliedAt), nullExecutionMs(record.ExecutionMs), record.Checksum)
 
 	return err
 }
 
-// DeleteMigration removes a migration record
-func (drv MySQLDriver) DeleteMigration(db Transaction, version string) error {
-	_, err := db.Exec("delete from schema_migrations where version = ?", version)
+// UpdateMigrationChecksum replaces the checksum recorded for a migration
+func (drv MySQLDriver) UpdateMigrationChecksum(ctx context.Context, db Transaction, table string, version string, project string, checksum string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("update %s set checksum = ? where version = ? and project = ?",
+		mySQLQuoteTable(table)), checksum, version, project)
+
+	return err
+}
+
+// DeleteMigration removes a migration record for a project
+func (drv MySQLDriver) DeleteMigration(ctx context.Context, db Transaction, table string, version string, project string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where version = ? and project = ?",
+		mySQLQuoteTable(table)), version, project)
+
+	return err
+}
+
+// DumpSchema returns the current database schema, as reported by `show
+// create` for each table, routine, view, trigger and event. The migrations
+// table is not included.
+func (drv MySQLDriver) DumpSchema(ctx context.Context, u *url.URL, db *sql.DB, migrationsTable string) ([]byte, error) {
+	// the migrations table may live in another database
+	migrationsSchema, migrationsName := splitTableName(migrationsTable)
+	if migrationsSchema != "" && migrationsSchema != databaseName(u) {
+		migrationsName = ""
+	}
+
+	rows, err := db.QueryContext(ctx, `select table_name, table_type from information_schema.tables
+		where table_schema = ? and table_name <> ?
+		order by table_type, table_name`, databaseName(u), migrationsName)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
+
+	type table struct {
+		name, kind string
+	}
+	tables := []table{}
+	for rows.Next() {
+		var t table
+		if err := rows.Scan(&t.name, &t.kind); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// strip details which vary between otherwise identical databases
+	autoIncrement := regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+	definer := regexp.MustCompile(` DEFINER=\S+`)
+
+	var buf bytes.Buffer
+	for _, t := range tables {
+		if t.kind == "VIEW" {
+			continue
+		}
+		var name, def string
+		err = db.QueryRowContext(ctx, fmt.Sprintf("show create table %s", quoteIdentifier(t.name))).
+			Scan(&name, &def)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buf, "%s;\n\n", autoIncrement.ReplaceAllString(def, ""))
+	}
+
+	// routines come before views, which may call them
+	routines, err := mySQLSchemaObjects(ctx, db, `select routine_type, routine_name
+		from information_schema.routines where routine_schema = ?
+		order by routine_type, routine_name`, databaseName(u))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routines {
+		if err := mySQLShowCreate(ctx, db, r.kind, r.name, &buf, definer); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, t := range tables {
+		if t.kind != "VIEW" {
+			continue
+		}
+		var name, def, charset, collation string
+		err = db.QueryRowContext(ctx, fmt.Sprintf("show create view %s", quoteIdentifier(t.name))).
+			Scan(&name, &def, &charset, &collation)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buf, "%s;\n\n", definer.ReplaceAllString(def, ""))
+	}
+
+	triggers, err := mySQLSchemaObjects(ctx, db, `select 'TRIGGER', trigger_name
+		from information_schema.triggers where trigger_schema = ?
+		order by event_object_table, action_timing, event_manipulation, action_order`, databaseName(u))
+	if err != nil {
+		return nil, err
+	}
+	events, err := mySQLSchemaObjects(ctx, db, `select 'EVENT', event_name
+		from information_schema.events where event_schema = ?
+		order by event_name`, databaseName(u))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range append(triggers, events...) {
+		if err := mySQLShowCreate(ctx, db, o.kind, o.name, &buf, definer); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// mySQLSchemaObject is a routine, trigger or event, where kind is what it's
+// called in `show create`, e.g. PROCEDURE
+type mySQLSchemaObject struct {
+	kind, name string
+}
+
+// mySQLSchemaObjects returns the kind and name of each object listed by query
+func mySQLSchemaObjects(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]mySQLSchemaObject, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
 
+	objects := []mySQLSchemaObject{}
+	for rows.Next() {
+		var o mySQLSchemaObject
+		if err := rows.Scan(&o.kind, &o.name); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+
+	return objects, rows.Err()
+}
+
+// mySQLShowCreate writes the statement which creates a routine, trigger or
+// event to buf. Its definition is in the column named e.g. `Create Procedure`
+// (or `SQL Original Statement` for triggers), among others which vary
+// between versions.
+func mySQLShowCreate(ctx context.Context, db *sql.DB, kind, name string, buf *bytes.Buffer,
+	definer *regexp.Regexp) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("show create %s %s", kind, quoteIdentifier(name)))
+	if err != nil {
+		return err
+	}
+	defer mustClose(rows)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("can't dump %s %s: not found", strings.ToLower(kind), name)
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	for i, column := range columns {
+		if !strings.EqualFold(column, "Create "+kind) && !strings.EqualFold(column, "SQL Original Statement") {
+			continue
+		}
+		// the definition is null without the privileges needed to read it
+		if !values[i].Valid {
+			return fmt.Errorf("can't dump %s %s: permission denied", strings.ToLower(kind), name)
+		}
+		fmt.Fprintf(buf, "%s;\n\n", definer.ReplaceAllString(values[i].String, ""))
+		return nil
+	}
+
+	return fmt.Errorf("can't dump %s %s: no definition in %s", strings.ToLower(kind), name,
+		strings.Join(columns, ", "))
+}
+
+// mySQLLockName shortens lock names longer than the 64 characters MySQL allows
+func mySQLLockName(name string) string {
+	if len(name) <= 64 {
+		return name
+	}
+
+	return fmt.Sprintf("dbmate:%x", sha1.Sum([]byte(name)))
+}
+
+// Lock acquires a named lock with GET_LOCK, retrying while another session
+// holds it until ctx is done. GET_LOCK only waits for whole seconds, so it is
+// polled rather than left to wait.
+func (drv MySQLDriver) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	for {
+		var acquired sql.NullInt64
+		err := conn.QueryRowContext(ctx, "select get_lock(?, 0)", mySQLLockName(name)).Scan(&acquired)
+		if err != nil {
+			return err
+		}
+		if !acquired.Valid {
+			return fmt.Errorf("unable to acquire lock %s", name)
+		}
+		if acquired.Int64 == 1 {
+			return nil
+		}
+
+		if err := waitToRetryLock(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Unlock releases a named lock taken by Lock on the same connection
+func (drv MySQLDriver) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "select release_lock(?)", mySQLLockName(name))
 	return err
 }
 
-// Lock locks the database so no other migrations can be run, no-op in MySQL
-func (drv MySQLDriver) Lock(db *sql.DB) error {
-	return nil
+// mySQLNearPattern matches the position in a MySQL syntax error, e.g.
+// "... for the right syntax to use near 'nmae varchar(255))' at line 3"
+var mySQLNearPattern = regexp.MustCompile(`(?s)near '(.*)' at line (\d+)$`)
+
+// errorOffset finds the position of a MySQL syntax error in a statement
+func (drv MySQLDriver) errorOffset(err error, stmt string) (int, bool) {
+	m := mySQLNearPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+
+	line, _ := strconv.Atoi(m[2])
+	return mySQLNearOffset(stmt, m[1], line)
 }
 
-// Unlock removes a database lock so other migrations can be run, no-op in MySQL
-func (drv MySQLDriver) Unlock(db *sql.DB) {
-	// no-op
+// mySQLNearOffset finds the text quoted in a MySQL syntax error, which starts
+// on the given line of the statement. MySQL quotes nothing when the error is
+// at the end of the statement, and truncates long text.
+func mySQLNearOffset(stmt, near string, line int) (int, bool) {
+	lineStart := 0
+	for i := 1; i < line; i++ {
+		next := strings.IndexByte(stmt[lineStart:], '\n')
+		if next < 0 {
+			return 0, false
+		}
+		lineStart += next + 1
+	}
+
+	if near == "" {
+		return len(strings.TrimRight(stmt, " \t\r\n")), true
+	}
+
+	// only the first line of the quoted text is needed to find it
+	near = near[:lineLength(near)]
+	if i := strings.Index(stmt[lineStart:], near); i >= 0 {
+		return lineStart + i, true
+	}
+
+	return lineStart, true
 }
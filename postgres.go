@@ -1,9 +1,20 @@
+//go:build !nopostgres
+// +build !nopostgres
+
 package dbmate
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/lib/pq"
 )
@@ -15,6 +26,11 @@ var LockTimeout = "30s"
 type PostgresDriver struct {
 }
 
+func init() {
+	RegisterDriver("postgres", func() Driver { return PostgresDriver{} })
+	RegisterDriver("postgresql", func() Driver { return PostgresDriver{} })
+}
+
 // Open creates a new database connection, also setting a lock timeout to 30 seconds for the whole session.
 func (drv PostgresDriver) Open(u *url.URL) (*sql.DB, error) {
 	db, err := sql.Open("postgres", u.String())
@@ -38,43 +54,38 @@ func (drv PostgresDriver) openPostgresDB(u *url.URL) (*sql.DB, error) {
 }
 
 // CreateDatabase creates the specified database
-func (drv PostgresDriver) CreateDatabase(u *url.URL) error {
+func (drv PostgresDriver) CreateDatabase(ctx context.Context, u *url.URL) error {
 	name := databaseName(u)
-	fmt.Printf("Creating: %s\n", name)
-
 	db, err := drv.openPostgresDB(u)
 	if err != nil {
 		return err
 	}
 	defer mustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("create database %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("create database %s",
 		pq.QuoteIdentifier(name)))
 
 	return err
 }
 
 // DropDatabase drops the specified database (if it exists)
-func (drv PostgresDriver) DropDatabase(u *url.URL) error {
+func (drv PostgresDriver) DropDatabase(ctx context.Context, u *url.URL) error {
 	name := databaseName(u)
-	fmt.Printf("Dropping: %s\n", name)
-
 	db, err := drv.openPostgresDB(u)
 	if err != nil {
 		return err
 	}
 	defer mustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("drop database if exists %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("drop database if exists %s",
 		pq.QuoteIdentifier(name)))
 
 	return err
 }
 
 // DatabaseExists determines whether the database exists
-func (drv PostgresDriver) DatabaseExists(u *url.URL) (bool, error) {
+func (drv PostgresDriver) DatabaseExists(ctx context.Context, u *url.URL) (bool, error) {
 	name := databaseName(u)
-
 	db, err := drv.openPostgresDB(u)
 	if err != nil {
 		return false, err
@@ -82,7 +93,7 @@ func (drv PostgresDriver) DatabaseExists(u *url.URL) (bool, error) {
 	defer mustClose(db)
 
 	exists := false
-	err = db.QueryRow("select true from pg_database where datname = $1", name).
+	err = db.QueryRowContext(ctx, "select true from pg_database where datname = $1", name).
 		Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -91,32 +102,105 @@ func (drv PostgresDriver) DatabaseExists(u *url.URL) (bool, error) {
 	return exists, err
 }
 
-// CreateMigrationsTable creates the schema_migrations table
-func (drv PostgresDriver) CreateMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(`create table if not exists schema_migrations (
-		version varchar(255) primary key)`)
+// postgresQuoteTable quotes a table name, which may be qualified with a schema
+func postgresQuoteTable(table string) string {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return pq.QuoteIdentifier(name)
+	}
+
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+}
+
+func (drv PostgresDriver) quoteTable(table string) string {
+	return postgresQuoteTable(table)
+}
+
+func (drv PostgresDriver) sqlDialect() sqlDialect {
+	return sqlDialect{NestedComments: true}
+}
+
+// MigrationsTableExists determines whether the migrations table exists
+func (drv PostgresDriver) MigrationsTableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	exists := false
+	err := db.QueryRowContext(ctx, `select true from information_schema.tables
+		where table_schema = coalesce(nullif($1, ''), current_schema()) and table_name = $2`,
+		schema, name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return exists, err
+}
+
+// CreateMigrationsTable creates the migrations table, and its schema if it
+// is qualified with one
+func (drv PostgresDriver) CreateMigrationsTable(ctx context.Context, db *sql.DB, table string) error {
+	if schema, _ := splitTableName(table); schema != "" {
+		// `create schema if not exists` needs the create privilege on the
+		// database even when the schema exists, so only run it when it doesn't
+		exists := false
+		err := db.QueryRowContext(ctx, "select exists (select 1 from pg_namespace where nspname = $1)",
+			schema).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			_, err = db.ExecContext(ctx, fmt.Sprintf("create schema if not exists %s",
+				pq.QuoteIdentifier(schema)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	quoted := postgresQuoteTable(table)
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+		version varchar(255) not null,
+		project varchar(255) not null default 'default',
+		primary key (project, version))`, quoted))
 	if err != nil {
 		return err
 	}
 
-	// Add the project column if it doesn't already exist.
-	_, err = db.Exec(`select project from schema_migrations limit 1`)
+	// add any columns introduced since the table was first created
+	err = addMigrationsColumns(ctx, db, quoted, []migrationsColumn{
+		{"project", "varchar(255) default 'default'"},
+		{"applied_at", "timestamp"},
+		{"execution_ms", "bigint"},
+		{"checksum", "varchar(64)"},
+	})
 	if err != nil {
-		_, err = db.Exec(`alter table schema_migrations
-			add column project varchar(255) default 'default'`)
+		return err
 	}
 
-	return err
+	var keyName string
+	keyColumns := func() (columns int, err error) {
+		err = db.QueryRowContext(ctx, `select conname, array_length(conkey, 1) from pg_constraint
+			where conrelid = $1::regclass and contype = 'p'`, quoted).Scan(&keyName, &columns)
+		return columns, err
+	}
+
+	return upgradeMigrationsPrimaryKey(keyColumns, func() error {
+		// both statements run in a single implicit transaction
+		_, err := db.ExecContext(ctx, fmt.Sprintf(`update %[1]s set project = 'default' where project is null;
+			alter table %[1]s alter column project set not null,
+				drop constraint %[2]s, add primary key (project, version)`,
+			quoted, pq.QuoteIdentifier(keyName)))
+		return err
+	})
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
-func (drv PostgresDriver) SelectMigrations(db *sql.DB, limit int, project string) (map[string]bool, error) {
-	query := "select version from schema_migrations where project = $1 order by version desc"
+func (drv PostgresDriver) SelectMigrations(ctx context.Context, db *sql.DB, table string, limit int, project string) (map[string]bool, error) {
+	query := fmt.Sprintf("select version from %s where project = $1 order by version desc",
+		postgresQuoteTable(table))
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query, project)
+	rows, err := db.QueryContext(ctx, query, project)
 	if err != nil {
 		return nil, err
 	}
@@ -136,32 +220,398 @@ func (drv PostgresDriver) SelectMigrations(db *sql.DB, limit int, project string
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the details of every applied migration
+// for a project, in ascending version order
+func (drv PostgresDriver) SelectMigrationRecords(ctx context.Context, db *sql.DB, table string, project string) ([]MigrationRecord, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`select version, project, applied_at, execution_ms, checksum
+		from %s where project = $1 order by version`, postgresQuoteTable(table)), project)
+	if err != nil {
+		return nil, err
+	}
+
+	defer mustClose(rows)
+
+	records := []MigrationRecord{}
+	for rows.Next() {
+		var record MigrationRecord
+		var appliedAt *time.Time
+		var executionMs sql.NullInt64
+		var checksum sql.NullString
+		if err := rows.Scan(&record.Version, &record.Project, &appliedAt, &executionMs, &checksum); err != nil {
+			return nil, err
+		}
+
+		if appliedAt != nil {
+			record.AppliedAt = *appliedAt
+		}
+		record.ExecutionMs = -1
+		if executionMs.Valid {
+			record.ExecutionMs = executionMs.Int64
+		}
+		record.Checksum = checksum.String
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
 // InsertMigration adds a new migration record
-func (drv PostgresDriver) InsertMigration(db Transaction, version string, project string) error {
-	_, err := db.Exec("insert into schema_migrations (version, project) values ($1, $2)", version, project)
+func (drv PostgresDriver) InsertMigration(ctx context.Context, db Transaction, table string, record MigrationRecord) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`insert into %s
+		(version, project, applied_at, execution_ms, checksum) values ($1, $2, $3, $4, $5)`,
+		postgresQuoteTable(table)),
+		record.Version, record.Project, nullTime(record.AppliedAt), nullExecutionMs(record.ExecutionMs), record.Checksum)
 
 	return err
 }
 
-// DeleteMigration removes a migration record
-func (drv PostgresDriver) DeleteMigration(db Transaction, version string) error {
-	_, err := db.Exec("delete from schema_migrations where version = $1", version)
+// UpdateMigrationChecksum replaces the checksum recorded for a migration
+func (drv PostgresDriver) UpdateMigrationChecksum(ctx context.Context, db Transaction, table string, version string, project string, checksum string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("update %s set checksum = $1 where version = $2 and project = $3",
+		postgresQuoteTable(table)), checksum, version, project)
 
 	return err
 }
 
-var lockKey = 48372615
+// DeleteMigration removes a migration record for a project
+func (drv PostgresDriver) DeleteMigration(ctx context.Context, db Transaction, table string, version string, project string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where version = $1 and project = $2",
+		postgresQuoteTable(table)), version, project)
 
-// Lock tries to acquire an advisory lock and waits for the configured LockTimeout seconds before giving up
-func (drv PostgresDriver) Lock(db *sql.DB) error {
-	_, err := db.Exec("select pg_advisory_lock($1)", lockKey)
 	return err
 }
 
-// Unlock releases an advisory lock
-func (drv PostgresDriver) Unlock(db *sql.DB) {
-	_, err := db.Exec("select pg_advisory_unlock($1)", lockKey)
+// postgresUserSchemas restricts catalog queries to non-system schemas
+const postgresUserSchemas = `n.nspname not in ('pg_catalog', 'information_schema')
+	and n.nspname not like 'pg\_%'`
+
+// postgresQuoteName quotes a relation name, qualifying it with its schema
+// unless it lives in the public schema
+func postgresQuoteName(schema, name string) string {
+	if schema == "public" {
+		return pq.QuoteIdentifier(name)
+	}
+
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+}
+
+// DumpSchema returns the current database schema, introspected from the
+// system catalogs. The migrations table is not included.
+func (drv PostgresDriver) DumpSchema(ctx context.Context, u *url.URL, db *sql.DB, table string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// extensions
+	extensions, err := queryColumn(ctx, db, `select extname from pg_extension
+		where extname <> 'plpgsql' order by extname`)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range extensions {
+		fmt.Fprintf(&buf, "create extension if not exists %s;\n\n", pq.QuoteIdentifier(ext))
+	}
+
+	// schemas
+	schemas, err := queryColumn(ctx, db, `select n.nspname from pg_namespace n
+		where `+postgresUserSchemas+` and n.nspname <> 'public' order by n.nspname`)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	for _, schema := range schemas {
+		// the migrations table's schema may already have been created with it
+		fmt.Fprintf(&buf, "create schema if not exists %s;\n\n", pq.QuoteIdentifier(schema))
 	}
+
+	// enum types
+	enums, err := queryColumn(ctx, db, `select format('create type %s as enum (%s);',
+			t.oid::regtype, string_agg(quote_literal(e.enumlabel), ', ' order by e.enumsortorder))
+		from pg_type t
+		join pg_enum e on e.enumtypid = t.oid
+		join pg_namespace n on n.oid = t.typnamespace
+		where `+postgresUserSchemas+`
+		group by n.nspname, t.typname, t.oid
+		order by n.nspname, t.typname`)
+	if err != nil {
+		return nil, err
+	}
+	for _, enum := range enums {
+		fmt.Fprintf(&buf, "%s\n\n", enum)
+	}
+
+	// sequences
+	sequences, err := queryColumn(ctx, db, `select format(
+			'create sequence %s start with %s increment by %s minvalue %s maxvalue %s%s;',
+			case when sequence_schema = 'public' then quote_ident(sequence_name)
+				else quote_ident(sequence_schema) || '.' || quote_ident(sequence_name) end,
+			start_value, increment, minimum_value, maximum_value,
+			case when cycle_option = 'YES' then ' cycle' else '' end)
+		from information_schema.sequences
+		where `+strings.Replace(postgresUserSchemas, "n.nspname", "sequence_schema", -1)+`
+		and not exists (
+			-- identity columns create their own sequences
+			select 1 from pg_depend d
+			join pg_class s on s.oid = d.objid
+			join pg_namespace sn on sn.oid = s.relnamespace
+			where sn.nspname = sequence_schema and s.relname = sequence_name and d.deptype = 'i')
+		order by sequence_schema, sequence_name`)
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range sequences {
+		fmt.Fprintf(&buf, "%s\n\n", seq)
+	}
+
+	// functions and procedures, except those belonging to extensions. Their
+	// bodies may refer to tables which are created later.
+	functions, err := queryColumn(ctx, db, `select pg_get_functiondef(p.oid)
+		from pg_proc p
+		join pg_namespace n on n.oid = p.pronamespace
+		where `+postgresUserSchemas+`
+		and p.oid not in (select aggfnoid from pg_aggregate)
+		and not exists (
+			select 1 from pg_depend d
+			where d.classid = 'pg_proc'::regclass and d.objid = p.oid and d.deptype = 'e')
+		order by n.nspname, p.proname, p.oid`)
+	if err != nil {
+		return nil, err
+	}
+	if len(functions) > 0 {
+		buf.WriteString("set check_function_bodies = false;\n\n")
+	}
+	for _, fn := range functions {
+		fmt.Fprintf(&buf, "%s;\n\n", strings.TrimSpace(fn))
+	}
+
+	// tables, along with their constraints and indexes
+	foreignKeys, err := drv.dumpTables(ctx, db, table, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// views
+	rows, err := db.QueryContext(ctx, `select n.nspname, c.relname, c.relkind, pg_get_viewdef(c.oid, true)
+		from pg_class c
+		join pg_namespace n on n.oid = c.relnamespace
+		where c.relkind in ('v', 'm') and `+postgresUserSchemas+`
+		order by n.nspname, c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
+
+	for rows.Next() {
+		var schema, name, kind, def string
+		if err := rows.Scan(&schema, &name, &kind, &def); err != nil {
+			return nil, err
+		}
+
+		view := "view"
+		if kind == "m" {
+			view = "materialized view"
+		}
+		def = strings.TrimSuffix(strings.TrimSpace(def), ";")
+		fmt.Fprintf(&buf, "create %s %s as\n %s;\n\n", view, postgresQuoteName(schema, name), def)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// foreign keys are added last, once every table they reference exists
+	for _, fk := range foreignKeys {
+		fmt.Fprintf(&buf, "%s\n\n", fk)
+	}
+
+	// triggers, once the tables and functions they use exist
+	triggers, err := queryColumn(ctx, db, `select pg_get_triggerdef(t.oid, true)
+		from pg_trigger t
+		join pg_class c on c.oid = t.tgrelid
+		join pg_namespace n on n.oid = c.relnamespace
+		where not t.tgisinternal and `+postgresUserSchemas+`
+		order by n.nspname, c.relname, t.tgname`)
+	if err != nil {
+		return nil, err
+	}
+	for _, trigger := range triggers {
+		fmt.Fprintf(&buf, "%s;\n\n", trigger)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// dumpTables writes the definition of every user table except the migrations
+// table to buf, returning foreign key constraints separately so they can be
+// written last
+func (drv PostgresDriver) dumpTables(ctx context.Context, db *sql.DB, migrationsTable string, buf *bytes.Buffer) ([]string, error) {
+	type table struct {
+		oid          int64
+		schema, name string
+	}
+
+	migrationsSchema, migrationsName := splitTableName(migrationsTable)
+	rows, err := db.QueryContext(ctx, `select c.oid, n.nspname, c.relname
+		from pg_class c
+		join pg_namespace n on n.oid = c.relnamespace
+		where c.relkind in ('r', 'p') and `+postgresUserSchemas+`
+		and not (n.nspname = coalesce(nullif($1, ''), current_schema()) and c.relname = $2)
+		order by n.nspname, c.relname`, migrationsSchema, migrationsName)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
+
+	tables := []table{}
+	for rows.Next() {
+		var t table
+		if err := rows.Scan(&t.oid, &t.schema, &t.name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// identity columns were added in Postgres 10, and generated columns in 12
+	var version int
+	err = db.QueryRowContext(ctx, "select current_setting('server_version_num')::int").Scan(&version)
+	if err != nil {
+		return nil, err
+	}
+	identity := "''"
+	if version >= 100000 {
+		identity = `case a.attidentity when 'a' then ' generated always as identity'
+			when 'd' then ' generated by default as identity' else '' end`
+	}
+	defaultExpr := "coalesce(' default ' || pg_get_expr(d.adbin, d.adrelid), '')"
+	if version >= 120000 {
+		defaultExpr = `case when a.attgenerated = 's'
+			then ' generated always as (' || pg_get_expr(d.adbin, d.adrelid) || ') stored'
+			else ` + defaultExpr + ` end`
+	}
+
+	foreignKeys := []string{}
+	for _, t := range tables {
+		name := postgresQuoteName(t.schema, t.name)
+
+		columns, err := queryColumn(ctx, db, `select format('%I %s%s%s%s',
+				a.attname, format_type(a.atttypid, a.atttypmod),
+				case when a.attnotnull then ' not null' else '' end,
+				`+defaultExpr+`, `+identity+`)
+			from pg_attribute a
+			left join pg_attrdef d on d.adrelid = a.attrelid and d.adnum = a.attnum
+			where a.attrelid = $1 and a.attnum > 0 and not a.attisdropped
+			order by a.attnum`, t.oid)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, "create table %s (\n    %s\n);\n\n", name, strings.Join(columns, ",\n    "))
+
+		constraints, err := db.QueryContext(ctx, `select conname, contype, pg_get_constraintdef(oid)
+			from pg_constraint where conrelid = $1 order by conname`, t.oid)
+		if err != nil {
+			return nil, err
+		}
+		for constraints.Next() {
+			var conname, contype, def string
+			if err = constraints.Scan(&conname, &contype, &def); err != nil {
+				break
+			}
+
+			stmt := fmt.Sprintf("alter table only %s add constraint %s %s;",
+				name, pq.QuoteIdentifier(conname), def)
+			if contype == "f" {
+				foreignKeys = append(foreignKeys, stmt)
+				continue
+			}
+			fmt.Fprintf(buf, "%s\n\n", stmt)
+		}
+		if err == nil {
+			err = constraints.Err()
+		}
+		mustClose(constraints)
+		if err != nil {
+			return nil, err
+		}
+
+		// indexes which back a constraint were created along with it
+		indexes, err := queryColumn(ctx, db, `select pg_get_indexdef(i.indexrelid)
+			from pg_index i
+			join pg_class c on c.oid = i.indexrelid
+			where i.indrelid = $1 and not exists (
+				select 1 from pg_constraint k
+				where k.conrelid = i.indrelid and k.conindid = i.indexrelid
+				and k.contype in ('p', 'u', 'x'))
+			order by c.relname`, t.oid)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indexes {
+			fmt.Fprintf(buf, "%s;\n\n", index)
+		}
+	}
+
+	return foreignKeys, nil
+}
+
+// postgresLockKey derives the advisory lock key for a lock name
+func postgresLockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// Lock acquires an advisory lock on the given connection, retrying while
+// another session holds it until ctx is done
+func (drv PostgresDriver) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	key := postgresLockKey(name)
+	for {
+		acquired := false
+		err := conn.QueryRowContext(ctx, "select pg_try_advisory_lock($1)", key).Scan(&acquired)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		if err := waitToRetryLock(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Unlock releases an advisory lock taken by Lock on the same connection
+func (drv PostgresDriver) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	released := false
+	err := conn.QueryRowContext(ctx, "select pg_advisory_unlock($1)",
+		postgresLockKey(name)).Scan(&released)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return fmt.Errorf("advisory lock %s was not held", name)
+	}
+
+	return nil
+}
+
+// errorOffset converts the position reported in a Postgres error, which
+// counts characters from 1, to a byte offset in the statement
+func (drv PostgresDriver) errorOffset(err error, stmt string) (int, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Position == "" {
+		return 0, false
+	}
+
+	pos, convErr := strconv.Atoi(pqErr.Position)
+	if convErr != nil || pos < 1 {
+		return 0, false
+	}
+
+	offset := 0
+	for i := 1; i < pos && offset < len(stmt); i++ {
+		_, size := utf8.DecodeRuneInString(stmt[offset:])
+		offset += size
+	}
+
+	return offset, true
 }
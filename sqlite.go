@@ -1,19 +1,32 @@
+//go:build cgo && !nosqlite
+// +build cgo,!nosqlite
+
 package dbmate
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3" // sqlite driver for database/sql
+	"github.com/mattn/go-sqlite3"
 )
 
 // SQLiteDriver provides top level database functions
 type SQLiteDriver struct {
 }
 
+func init() {
+	RegisterDriver("sqlite", func() Driver { return SQLiteDriver{} })
+	RegisterDriver("sqlite3", func() Driver { return SQLiteDriver{} })
+}
+
 func sqlitePath(u *url.URL) string {
 	// strip one leading slash
 	// absolute URLs can be specified as sqlite:////tmp/foo.sqlite3
@@ -27,25 +40,39 @@ func (drv SQLiteDriver) Open(u *url.URL) (*sql.DB, error) {
 	return sql.Open("sqlite3", sqlitePath(u))
 }
 
-// CreateDatabase creates the specified database
-func (drv SQLiteDriver) CreateDatabase(u *url.URL) error {
-	fmt.Printf("Creating: %s\n", sqlitePath(u))
+// sqliteQuoteTable quotes a table name, which may be qualified with the name
+// of an attached database
+func sqliteQuoteTable(table string) string {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return sqliteQuoteIdentifier(name)
+	}
+
+	return sqliteQuoteIdentifier(schema) + "." + sqliteQuoteIdentifier(name)
+}
 
+func (drv SQLiteDriver) quoteTable(table string) string {
+	return sqliteQuoteTable(table)
+}
+
+func sqliteQuoteIdentifier(str string) string {
+	return `"` + strings.Replace(str, `"`, `""`, -1) + `"`
+}
+
+// CreateDatabase creates the specified database
+func (drv SQLiteDriver) CreateDatabase(ctx context.Context, u *url.URL) error {
 	db, err := drv.Open(u)
 	if err != nil {
 		return err
 	}
 	defer mustClose(db)
 
-	return db.Ping()
+	return db.PingContext(ctx)
 }
 
 // DropDatabase drops the specified database (if it exists)
-func (drv SQLiteDriver) DropDatabase(u *url.URL) error {
-	path := sqlitePath(u)
-	fmt.Printf("Dropping: %s\n", path)
-
-	exists, err := drv.DatabaseExists(u)
+func (drv SQLiteDriver) DropDatabase(ctx context.Context, u *url.URL) error {
+	exists, err := drv.DatabaseExists(ctx, u)
 	if err != nil {
 		return err
 	}
@@ -53,11 +80,11 @@ func (drv SQLiteDriver) DropDatabase(u *url.URL) error {
 		return nil
 	}
 
-	return os.Remove(path)
+	return os.Remove(sqlitePath(u))
 }
 
 // DatabaseExists determines whether the database exists
-func (drv SQLiteDriver) DatabaseExists(u *url.URL) (bool, error) {
+func (drv SQLiteDriver) DatabaseExists(ctx context.Context, u *url.URL) (bool, error) {
 	_, err := os.Stat(sqlitePath(u))
 	if os.IsNotExist(err) {
 		return false, nil
@@ -69,32 +96,123 @@ func (drv SQLiteDriver) DatabaseExists(u *url.URL) (bool, error) {
 	return true, nil
 }
 
-// CreateMigrationsTable creates the schema_migrations table
-func (drv SQLiteDriver) CreateMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(`create table if not exists schema_migrations (
-		version varchar(255) primary key)`)
+// MigrationsTableExists determines whether the migrations table exists
+func (drv SQLiteDriver) MigrationsTableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	master := "sqlite_master"
+	if schema != "" {
+		master = sqliteQuoteIdentifier(schema) + ".sqlite_master"
+	}
+
+	exists := false
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`select 1 from %s
+		where type = 'table' and name = ?`, master), name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return exists, err
+}
+
+// CreateMigrationsTable creates the migrations table
+func (drv SQLiteDriver) CreateMigrationsTable(ctx context.Context, db *sql.DB, table string) error {
+	quoted := sqliteQuoteTable(table)
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+		version varchar(255) not null,
+		project varchar(255) not null default 'default',
+		primary key (project, version))`, quoted))
 	if err != nil {
 		return err
 	}
 
-	// Add the project column if it doesn't already exist.
-	_, err = db.Exec(`select project from schema_migrations limit 1`)
+	// add any columns introduced since the table was first created
+	err = addMigrationsColumns(ctx, db, quoted, []migrationsColumn{
+		{"project", "varchar(255) default 'default'"},
+		{"applied_at", "datetime"},
+		{"execution_ms", "bigint"},
+		{"checksum", "varchar(64)"},
+	})
 	if err != nil {
-		_, err = db.Exec(`alter table schema_migrations
-			add column project varchar(255) default 'default'`)
+		return err
 	}
 
-	return err
+	return upgradeMigrationsPrimaryKey(func() (int, error) {
+		return sqlitePrimaryKeyColumns(ctx, db, table)
+	}, func() error {
+		return sqliteRebuildMigrationsTable(ctx, db, table)
+	})
+}
+
+// sqlitePrimaryKeyColumns returns the number of columns in a table's primary key
+func sqlitePrimaryKeyColumns(ctx context.Context, db *sql.DB, table string) (int, error) {
+	schema, name := splitTableName(table)
+	pragma := "pragma "
+	if schema != "" {
+		pragma += sqliteQuoteIdentifier(schema) + "."
+	}
+
+	rows, err := db.QueryContext(ctx, pragma+"table_info("+sqliteQuoteIdentifier(name)+")")
+	if err != nil {
+		return 0, err
+	}
+	defer mustClose(rows)
+
+	columns := 0
+	for rows.Next() {
+		var cid, notNull, pk int
+		var colName, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &colName, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return 0, err
+		}
+		if pk > 0 {
+			columns++
+		}
+	}
+
+	return columns, rows.Err()
+}
+
+// sqliteRebuildMigrationsTable recreates the migrations table with a primary
+// key on (project, version), since SQLite can't alter a primary key
+func sqliteRebuildMigrationsTable(ctx context.Context, db *sql.DB, table string) error {
+	quoted := sqliteQuoteTable(table)
+	tmp := sqliteQuoteTable(table + "_upgrade")
+	_, name := splitTableName(table)
+
+	return doTransaction(ctx, db, func(tx Transaction) error {
+		for _, stmt := range []string{
+			fmt.Sprintf(`create table %s (
+				version varchar(255) not null,
+				project varchar(255) not null default 'default',
+				applied_at datetime,
+				execution_ms bigint,
+				checksum varchar(64),
+				primary key (project, version))`, tmp),
+			fmt.Sprintf(`insert into %s (version, project, applied_at, execution_ms, checksum)
+				select version, coalesce(project, 'default'), applied_at, execution_ms, checksum
+				from %s`, tmp, quoted),
+			fmt.Sprintf("drop table %s", quoted),
+			fmt.Sprintf("alter table %s rename to %s", tmp, sqliteQuoteIdentifier(name)),
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
-func (drv SQLiteDriver) SelectMigrations(db *sql.DB, limit int, project string) (map[string]bool, error) {
-	query := "select version from schema_migrations where project = ? order by version desc"
+func (drv SQLiteDriver) SelectMigrations(ctx context.Context, db *sql.DB, table string, limit int, project string) (map[string]bool, error) {
+	query := fmt.Sprintf("select version from %s where project = ? order by version desc",
+		sqliteQuoteTable(table))
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query, project)
+	rows, err := db.QueryContext(ctx, query, project)
 	if err != nil {
 		return nil, err
 	}
@@ -114,26 +232,214 @@ func (drv SQLiteDriver) SelectMigrations(db *sql.DB, limit int, project string)
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the details of every applied migration
+// for a project, in ascending version order
+func (drv SQLiteDriver) SelectMigrationRecords(ctx context.Context, db *sql.DB, table string, project string) ([]MigrationRecord, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`select version, project, applied_at, execution_ms, checksum
+		from %s where project = ? order by version`, sqliteQuoteTable(table)), project)
+	if err != nil {
+		return nil, err
+	}
+
+	defer mustClose(rows)
+
+	records := []MigrationRecord{}
+	for rows.Next() {
+		var record MigrationRecord
+		var appliedAt *time.Time
+		var executionMs sql.NullInt64
+		var checksum sql.NullString
+		if err := rows.Scan(&record.Version, &record.Project, &appliedAt, &executionMs, &checksum); err != nil {
+			return nil, err
+		}
+
+		if appliedAt != nil {
+			record.AppliedAt = *appliedAt
+		}
+		record.ExecutionMs = -1
+		if executionMs.Valid {
+			record.ExecutionMs = executionMs.Int64
+		}
+		record.Checksum = checksum.String
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
 // InsertMigration adds a new migration record
-func (drv SQLiteDriver) InsertMigration(db Transaction, version string, project string) error {
-	_, err := db.Exec("insert into schema_migrations (version, project) values (?, ?)", version, project)
+func (drv SQLiteDriver) InsertMigration(ctx context.Context, db Transaction, table string, record MigrationRecord) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`insert into %s
+		(version, project, applied_at, execution_ms, checksum) values (?, ?, ?, ?, ?)`,
+		sqliteQuoteTable(table)),
+		record.Version, record.Project, nullTime(record.AppliedAt), nullExecutionMs(record.ExecutionMs), record.Checksum)
 
 	return err
 }
 
-// DeleteMigration removes a migration record
-func (drv SQLiteDriver) DeleteMigration(db Transaction, version string) error {
-	_, err := db.Exec("delete from schema_migrations where version = ?", version)
+// UpdateMigrationChecksum replaces the checksum recorded for a migration
+func (drv SQLiteDriver) UpdateMigrationChecksum(ctx context.Context, db Transaction, table string, version string, project string, checksum string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("update %s set checksum = ? where version = ? and project = ?",
+		sqliteQuoteTable(table)), checksum, version, project)
 
 	return err
 }
 
-// Lock locks the database so no other migrations can be run, no-op in SQLite
-func (drv SQLiteDriver) Lock(db *sql.DB) error {
-	return nil
+// DeleteMigration removes a migration record for a project
+func (drv SQLiteDriver) DeleteMigration(ctx context.Context, db Transaction, table string, version string, project string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where version = ? and project = ?",
+		sqliteQuoteTable(table)), version, project)
+
+	return err
+}
+
+// DumpSchema returns the current database schema, as recorded in
+// sqlite_master. The migrations and schema_migrations_lock tables are not
+// included.
+func (drv SQLiteDriver) DumpSchema(ctx context.Context, u *url.URL, db *sql.DB, table string) ([]byte, error) {
+	// the migrations table may live in an attached database
+	schema, name := splitTableName(table)
+	if schema != "" && schema != "main" {
+		name = ""
+	}
+
+	statements, err := queryColumn(ctx, db, `select sql from sqlite_master
+		where sql is not null and name not like 'sqlite_%'
+		and tbl_name not in (?, 'schema_migrations_lock')
+		order by case type when 'table' then 1 when 'index' then 2 when 'view' then 3 else 4 end,
+		tbl_name, name`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, stmt := range statements {
+		fmt.Fprintf(&buf, "%s;\n\n", stmt)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sqliteLockStaleAfter is how long a row in schema_migrations_lock is trusted.
+// SQLite has no session locks which are released when a process dies, so a
+// row which hasn't been refreshed for longer is assumed to have been left by a
+// process which was killed.
+var sqliteLockStaleAfter = 10 * time.Minute
+
+// sqliteLockRefreshInterval is how often the process holding a lock updates
+// its row in schema_migrations_lock
+var sqliteLockRefreshInterval = time.Minute
+
+// sqliteLockRefreshes holds the function which stops refreshing each lock
+// held by this process
+var sqliteLockRefreshes = struct {
+	sync.Mutex
+	stop map[sqliteLockKey]func()
+}{stop: map[sqliteLockKey]func(){}}
+
+type sqliteLockKey struct {
+	conn *sql.Conn
+	name string
 }
 
-// Unlock removes a database lock so other migrations can be run, no-op in SQLite
-func (drv SQLiteDriver) Unlock(db *sql.DB) {
-	// no-op
+// Lock acquires a lock by inserting a row into the schema_migrations_lock
+// table, retrying while another process holds it until ctx is done. A row
+// older than sqliteLockStaleAfter is removed first. While the lock is held,
+// its row is refreshed every sqliteLockRefreshInterval.
+func (drv SQLiteDriver) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, `create table if not exists schema_migrations_lock (
+		name varchar(255) primary key,
+		acquired_at datetime not null)`)
+	if err != nil {
+		return err
+	}
+
+	for {
+		now := time.Now().UTC()
+		_, err := conn.ExecContext(ctx, `delete from schema_migrations_lock
+			where name = ? and acquired_at < ?`, name, now.Add(-sqliteLockStaleAfter))
+		if err != nil && !sqliteLockHeld(err) {
+			return err
+		}
+
+		_, err = conn.ExecContext(ctx, `insert into schema_migrations_lock (name, acquired_at)
+			values (?, ?)`, name, now)
+		if err == nil {
+			sqliteRefreshLock(conn, name)
+			return nil
+		}
+		if !sqliteLockHeld(err) {
+			return err
+		}
+
+		if err := waitToRetryLock(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// sqliteRefreshLock updates the time on a lock's row in the background, so
+// other processes don't take it over however long the migration takes, until
+// sqliteStopRefreshingLock is called. Failures (such as while a migration is
+// writing to the database) are retried at the next interval.
+func sqliteRefreshLock(conn *sql.Conn, name string) {
+	sqliteStopRefreshingLock(conn, name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ticker := time.NewTicker(sqliteLockRefreshInterval)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = conn.ExecContext(ctx, "update schema_migrations_lock set acquired_at = ? where name = ?",
+					time.Now().UTC(), name)
+			}
+		}
+	}()
+
+	sqliteLockRefreshes.Lock()
+	defer sqliteLockRefreshes.Unlock()
+	sqliteLockRefreshes.stop[sqliteLockKey{conn, name}] = func() {
+		cancel()
+		<-done
+	}
+}
+
+// sqliteStopRefreshingLock stops refreshing a lock taken by Lock
+func sqliteStopRefreshingLock(conn *sql.Conn, name string) {
+	key := sqliteLockKey{conn, name}
+	sqliteLockRefreshes.Lock()
+	stop, ok := sqliteLockRefreshes.stop[key]
+	delete(sqliteLockRefreshes.stop, key)
+	sqliteLockRefreshes.Unlock()
+
+	if ok {
+		stop()
+	}
+}
+
+// sqliteLockHeld reports whether an error means another process holds the lock
+func sqliteLockHeld(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return false
+	}
+
+	return sqliteErr.Code == sqlite3.ErrConstraint ||
+		sqliteErr.Code == sqlite3.ErrBusy ||
+		sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// Unlock releases a lock taken by Lock
+func (drv SQLiteDriver) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	sqliteStopRefreshingLock(conn, name)
+
+	_, err := conn.ExecContext(ctx,
+		"delete from schema_migrations_lock where name = ?", name)
+	return err
 }
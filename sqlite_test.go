@@ -1,31 +1,28 @@
+//go:build cgo && !nosqlite
+// +build cgo,!nosqlite
+
 package dbmate
 
 import (
+	"context"
 	"database/sql"
-	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
-func sqliteTestURL(t *testing.T) *url.URL {
-	u, err := url.Parse("sqlite3:////tmp/dbmate.sqlite3")
-	require.Nil(t, err)
-
-	return u
-}
-
 func prepTestSQLiteDB(t *testing.T) *sql.DB {
 	drv := SQLiteDriver{}
 	u := sqliteTestURL(t)
 
 	// drop any existing database
-	err := drv.DropDatabase(u)
+	err := drv.DropDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// create database
-	err = drv.CreateDatabase(u)
+	err = drv.CreateDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// connect database
@@ -40,11 +37,11 @@ func TestSQLiteCreateDropDatabase(t *testing.T) {
 	u := sqliteTestURL(t)
 
 	// drop any existing database
-	err := drv.DropDatabase(u)
+	err := drv.DropDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// create database
-	err = drv.CreateDatabase(u)
+	err = drv.CreateDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// check that database exists
@@ -52,7 +49,7 @@ func TestSQLiteCreateDropDatabase(t *testing.T) {
 	require.Nil(t, err)
 
 	// drop the database
-	err = drv.DropDatabase(u)
+	err = drv.DropDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// check that database no longer exists
@@ -66,20 +63,37 @@ func TestSQLiteDatabaseExists(t *testing.T) {
 	u := sqliteTestURL(t)
 
 	// drop any existing database
-	err := drv.DropDatabase(u)
+	err := drv.DropDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// DatabaseExists should return false
-	exists, err := drv.DatabaseExists(u)
+	exists, err := drv.DatabaseExists(context.Background(), u)
 	require.Nil(t, err)
 	require.Equal(t, false, exists)
 
 	// create database
-	err = drv.CreateDatabase(u)
+	err = drv.CreateDatabase(context.Background(), u)
 	require.Nil(t, err)
 
 	// DatabaseExists should return true
-	exists, err = drv.DatabaseExists(u)
+	exists, err = drv.DatabaseExists(context.Background(), u)
+	require.Nil(t, err)
+	require.Equal(t, true, exists)
+}
+
+func TestSQLiteMigrationsTableExists(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	exists, err := drv.MigrationsTableExists(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+	require.Equal(t, false, exists)
+
+	err = drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+
+	exists, err = drv.MigrationsTableExists(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 	require.Equal(t, true, exists)
 }
@@ -95,7 +109,7 @@ func TestSQLiteCreateMigrationsTable(t *testing.T) {
 	require.Regexp(t, "no such table: schema_migrations", err.Error())
 
 	// create table
-	err = drv.CreateMigrationsTable(db)
+	err = drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 
 	// migrations table should exist
@@ -103,7 +117,66 @@ func TestSQLiteCreateMigrationsTable(t *testing.T) {
 	require.Nil(t, err)
 
 	// create table should be idempotent
-	err = drv.CreateMigrationsTable(db)
+	err = drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+}
+
+func TestSQLiteCreateMigrationsTable_CustomName(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	for _, table := range []string{"dbmate_migrations", `main."odd" name`} {
+		err := drv.CreateMigrationsTable(context.Background(), db, table)
+		require.Nil(t, err)
+
+		exists, err := drv.MigrationsTableExists(context.Background(), db, table)
+		require.Nil(t, err)
+		require.Equal(t, true, exists)
+
+		err = drv.InsertMigration(context.Background(), db, table, MigrationRecord{Version: "abc1", Project: "default"})
+		require.Nil(t, err)
+		migrations, err := drv.SelectMigrations(context.Background(), db, table, -1, "default")
+		require.Nil(t, err)
+		require.Equal(t, map[string]bool{"abc1": true}, migrations)
+	}
+
+	count := 0
+	err := db.QueryRow(`select count(*) from """odd"" name"`).Scan(&count)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	exists, err := drv.MigrationsTableExists(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+	require.Equal(t, false, exists)
+}
+
+func TestSQLiteCreateMigrationsTable_Upgrade(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	// table created by an earlier version of dbmate
+	_, err := db.Exec(`create table schema_migrations (version varchar(255) primary key)`)
+	require.Nil(t, err)
+	_, err = db.Exec(`insert into schema_migrations (version) values ('abc1')`)
+	require.Nil(t, err)
+
+	err = drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+
+	// existing rows are kept, and new columns are added
+	records, err := drv.SelectMigrationRecords(context.Background(), db, "schema_migrations", "default")
+	require.Nil(t, err)
+	require.Equal(t, []MigrationRecord{{Version: "abc1", Project: "default", ExecutionMs: -1}}, records)
+
+	// the primary key now includes the project, so other projects can record
+	// the same version
+	_, err = db.Exec(`insert into schema_migrations (version, project) values ('abc1', 'other')`)
+	require.Nil(t, err)
+
+	// upgrading again is a no-op
+	err = drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 }
 
@@ -112,21 +185,21 @@ func TestSQLiteSelectMigrations(t *testing.T) {
 	db := prepTestSQLiteDB(t)
 	defer mustClose(db)
 
-	err := drv.CreateMigrationsTable(db)
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 
 	_, err = db.Exec(`insert into schema_migrations (version)
 		values ('abc2'), ('abc1'), ('abc3')`)
 	require.Nil(t, err)
 
-	migrations, err := drv.SelectMigrations(db, -1, "default")
+	migrations, err := drv.SelectMigrations(context.Background(), db, "schema_migrations", -1, "default")
 	require.Nil(t, err)
 	require.Equal(t, true, migrations["abc1"])
 	require.Equal(t, true, migrations["abc2"])
 	require.Equal(t, true, migrations["abc2"])
 
 	// test limit param
-	migrations, err = drv.SelectMigrations(db, 1, "default")
+	migrations, err = drv.SelectMigrations(context.Background(), db, "schema_migrations", 1, "default")
 	require.Nil(t, err)
 	require.Equal(t, true, migrations["abc3"])
 	require.Equal(t, false, migrations["abc1"])
@@ -136,7 +209,7 @@ func TestSQLiteSelectMigrations(t *testing.T) {
 	_, err = db.Exec(`insert into schema_migrations (version, project)
 		values ('bcd1', 'app2')`)
 	require.Nil(t, err)
-	migrations, err = drv.SelectMigrations(db, -1, "app2")
+	migrations, err = drv.SelectMigrations(context.Background(), db, "schema_migrations", -1, "app2")
 	require.Nil(t, err)
 	require.Equal(t, true, migrations["bcd1"])
 	require.Equal(t, false, migrations["abc1"])
@@ -149,7 +222,7 @@ func TestSQLiteInsertMigration(t *testing.T) {
 	db := prepTestSQLiteDB(t)
 	defer mustClose(db)
 
-	err := drv.CreateMigrationsTable(db)
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 
 	count := 0
@@ -158,7 +231,7 @@ func TestSQLiteInsertMigration(t *testing.T) {
 	require.Equal(t, 0, count)
 
 	// insert migration
-	err = drv.InsertMigration(db, "abc1", "default")
+	err = drv.InsertMigration(context.Background(), db, "schema_migrations", MigrationRecord{Version: "abc1", Project: "default"})
 	require.Nil(t, err)
 
 	err = db.QueryRow("select count(*) from schema_migrations where version = 'abc1'").
@@ -167,23 +240,234 @@ func TestSQLiteInsertMigration(t *testing.T) {
 	require.Equal(t, 1, count)
 }
 
+func TestSQLiteSelectMigrationRecords(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+
+	appliedAt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = drv.InsertMigration(context.Background(), db, "schema_migrations", MigrationRecord{
+		Version:     "abc2",
+		Project:     "default",
+		AppliedAt:   appliedAt,
+		ExecutionMs: 42,
+		Checksum:    "deadbeef",
+	})
+	require.Nil(t, err)
+
+	// migrations recorded before details were tracked
+	_, err = db.Exec(`insert into schema_migrations (version) values ('abc1')`)
+	require.Nil(t, err)
+	_, err = db.Exec(`insert into schema_migrations (version, project) values ('bcd1', 'app2')`)
+	require.Nil(t, err)
+
+	records, err := drv.SelectMigrationRecords(context.Background(), db, "schema_migrations", "default")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, MigrationRecord{Version: "abc1", Project: "default", ExecutionMs: -1}, records[0])
+	require.Equal(t, "abc2", records[1].Version)
+	require.Equal(t, "default", records[1].Project)
+	require.Equal(t, true, appliedAt.Equal(records[1].AppliedAt))
+	require.Equal(t, int64(42), records[1].ExecutionMs)
+	require.Equal(t, "deadbeef", records[1].Checksum)
+}
+
+func TestSQLiteUpdateMigrationChecksum(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+
+	_, err = db.Exec(`insert into schema_migrations (version, project, checksum)
+		values ('abc1', 'default', 'old'), ('abc2', 'default', 'old')`)
+	require.Nil(t, err)
+
+	err = drv.UpdateMigrationChecksum(context.Background(), db, "schema_migrations", "abc1", "default", "new")
+	require.Nil(t, err)
+
+	checksum := ""
+	err = db.QueryRow("select checksum from schema_migrations where version = 'abc1'").Scan(&checksum)
+	require.Nil(t, err)
+	require.Equal(t, "new", checksum)
+	err = db.QueryRow("select checksum from schema_migrations where version = 'abc2'").Scan(&checksum)
+	require.Nil(t, err)
+	require.Equal(t, "old", checksum)
+}
+
 func TestSQLiteDeleteMigration(t *testing.T) {
 	drv := SQLiteDriver{}
 	db := prepTestSQLiteDB(t)
 	defer mustClose(db)
 
-	err := drv.CreateMigrationsTable(db)
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
 	require.Nil(t, err)
 
-	_, err = db.Exec(`insert into schema_migrations (version)
-		values ('abc1'), ('abc2')`)
+	_, err = db.Exec(`insert into schema_migrations (version, project)
+		values ('abc1', 'default'), ('abc2', 'default'), ('abc2', 'other')`)
 	require.Nil(t, err)
 
-	err = drv.DeleteMigration(db, "abc2")
+	err = drv.DeleteMigration(context.Background(), db, "schema_migrations", "abc2", "default")
 	require.Nil(t, err)
 
+	// only the record for the given project is removed
 	count := 0
 	err = db.QueryRow("select count(*) from schema_migrations").Scan(&count)
 	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	err = db.QueryRow("select count(*) from schema_migrations where version = 'abc2'").Scan(&count)
+	require.Nil(t, err)
 	require.Equal(t, 1, count)
 }
+
+func TestSQLiteLock(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	conn1, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer mustClose(conn1)
+	conn2, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer mustClose(conn2)
+
+	err = drv.Lock(context.Background(), conn1, "dbmate:test")
+	require.Nil(t, err)
+
+	// another session can't take the lock while it is held
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = drv.Lock(ctx, conn2, "dbmate:test")
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// but can take a lock with a different name
+	err = drv.Lock(context.Background(), conn2, "dbmate:other")
+	require.Nil(t, err)
+	err = drv.Unlock(context.Background(), conn2, "dbmate:other")
+	require.Nil(t, err)
+
+	// and can take the lock once it is released
+	err = drv.Unlock(context.Background(), conn1, "dbmate:test")
+	require.Nil(t, err)
+	err = drv.Lock(context.Background(), conn2, "dbmate:test")
+	require.Nil(t, err)
+	err = drv.Unlock(context.Background(), conn2, "dbmate:test")
+	require.Nil(t, err)
+}
+
+func TestSQLiteLock_Stale(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	conn, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer mustClose(conn)
+
+	// a lock left behind by a process which was killed
+	err = drv.Lock(context.Background(), conn, "dbmate:test")
+	require.Nil(t, err)
+	_, err = db.Exec("update schema_migrations_lock set acquired_at = ?",
+		time.Now().UTC().Add(-sqliteLockStaleAfter-time.Second))
+	require.Nil(t, err)
+
+	// is taken over by the next run
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = drv.Lock(ctx, conn, "dbmate:test")
+	require.Nil(t, err)
+
+	// but a recent lock isn't
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = drv.Lock(ctx, conn, "dbmate:test")
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSQLiteLock_Refresh(t *testing.T) {
+	drv := SQLiteDriver{}
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	defer func(interval time.Duration) { sqliteLockRefreshInterval = interval }(sqliteLockRefreshInterval)
+	sqliteLockRefreshInterval = 50 * time.Millisecond
+
+	conn1, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer mustClose(conn1)
+	conn2, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer mustClose(conn2)
+
+	err = drv.Lock(context.Background(), conn1, "dbmate:test")
+	require.Nil(t, err)
+	_, err = db.Exec("update schema_migrations_lock set acquired_at = ?",
+		time.Now().UTC().Add(-sqliteLockStaleAfter-time.Second))
+	require.Nil(t, err)
+
+	// a lock held for longer than sqliteLockStaleAfter is refreshed, so it
+	// isn't taken over
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = drv.Lock(ctx, conn2, "dbmate:test")
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// refreshing stops once it's released
+	err = drv.Unlock(context.Background(), conn1, "dbmate:test")
+	require.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	count := 0
+	err = db.QueryRow("select count(*) from schema_migrations_lock").Scan(&count)
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestSQLiteDumpSchema(t *testing.T) {
+	drv := SQLiteDriver{}
+	u := sqliteTestURL(t)
+	db := prepTestSQLiteDB(t)
+	defer mustClose(db)
+
+	err := drv.CreateMigrationsTable(context.Background(), db, "schema_migrations")
+	require.Nil(t, err)
+
+	_, err = db.Exec(`create view user_names as select name from users;
+		create table users (id integer primary key, name varchar(255));
+		create index users_name_idx on users (name)`)
+	require.Nil(t, err)
+
+	schema, err := drv.DumpSchema(context.Background(), u, db, "schema_migrations")
+	require.Nil(t, err)
+	require.Equal(t, "CREATE TABLE users (id integer primary key, name varchar(255));\n\n"+
+		"CREATE INDEX users_name_idx on users (name);\n\n"+
+		"CREATE VIEW user_names as select name from users;\n\n", string(schema))
+}
+
+func TestGetDriver_SQLite(t *testing.T) {
+	drv, err := GetDriver("sqlite3")
+	require.Nil(t, err)
+	_, ok := drv.(SQLiteDriver)
+	require.Equal(t, true, ok)
+}
+
+func TestRegisterDriver_Override(t *testing.T) {
+	RegisterDriver("sqlite", func() Driver { return testDriver{} })
+	defer RegisterDriver("sqlite", func() Driver { return SQLiteDriver{} })
+
+	drv, err := GetDriver("sqlite")
+	require.Nil(t, err)
+	_, ok := drv.(testDriver)
+	require.Equal(t, true, ok)
+
+	// other schemes for the same driver are unaffected
+	drv, err = GetDriver("sqlite3")
+	require.Nil(t, err)
+	_, ok = drv.(SQLiteDriver)
+	require.Equal(t, true, ok)
+}
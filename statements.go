@@ -0,0 +1,292 @@
+package dbmate
+
+import (
+	"strings"
+	"unicode"
+)
+
+// sqlStatement is a single statement from a migration section, along with the
+// byte offset of SQL in the section and the line on which its first token
+// (after any comments) appears
+type sqlStatement struct {
+	SQL    string
+	Offset int
+	Line   int
+}
+
+// sqlDialect describes the syntax which differs between databases when
+// splitting statements
+type sqlDialect struct {
+	// BackslashEscapes is set if a backslash escapes the next character in
+	// strings, as in MySQL
+	BackslashEscapes bool
+	// HashComments is set if # starts a comment running to the end of the
+	// line, as in MySQL
+	HashComments bool
+	// NestedComments is set if /* ... */ comments nest, as in Postgres
+	NestedComments bool
+}
+
+// dialectDriver is implemented by drivers whose SQL syntax differs from the
+// default sqlDialect
+type dialectDriver interface {
+	sqlDialect() sqlDialect
+}
+
+// splitStatements splits the SQL in a migration section into statements, so
+// each can be executed on its own. Statements end with a semicolon, or with
+// the delimiter chosen by a MySQL style `DELIMITER` line, except inside quoted
+// strings and identifiers, comments and Postgres dollar-quoted bodies. The
+// BEGIN ... END body of a trigger, function or procedure (such as an SQLite
+// trigger, or a Postgres `BEGIN ATOMIC` function) is kept in one statement.
+// The delimiter itself and any statements containing only comments are
+// dropped. Backslash escapes and comment syntax follow dialect, and a
+// backslash always escapes the next character in Postgres E'...' strings.
+func splitStatements(contents string, dialect sqlDialect) []sqlStatement {
+	statements := []sqlStatement{}
+	delimiter := ";"
+	start := 0
+	line := 1
+	codeLine := 0 // line on which the current statement's SQL starts
+
+	// the words seen so far in the current statement decide whether BEGIN
+	// starts a block, and depth is how many BEGIN or CASE blocks are open
+	words := 0
+	create, routine := false, false
+	depth := 0
+
+	end := func(i int) {
+		if codeLine > 0 {
+			trimmed := strings.TrimLeftFunc(contents[start:i], unicode.IsSpace)
+			statements = append(statements, sqlStatement{
+				SQL:    strings.TrimRightFunc(trimmed, unicode.IsSpace),
+				Offset: i - len(trimmed),
+				Line:   codeLine,
+			})
+		}
+		codeLine = 0
+		words, create, routine, depth = 0, false, false, 0
+	}
+
+	// skip moves past contents[i:j], counting lines
+	i := 0
+	skip := func(j int) {
+		line += strings.Count(contents[i:j], "\n")
+		i = j
+	}
+
+	for i < len(contents) {
+		rest := contents[i:]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r' || rest[0] == '\n':
+			skip(i + 1)
+			continue
+		case strings.HasPrefix(rest, "--") || (dialect.HashComments && rest[0] == '#'):
+			skip(i + lineLength(rest))
+			continue
+		case strings.HasPrefix(rest, "/*"):
+			skip(i + blockCommentLength(rest, dialect.NestedComments))
+			continue
+		case codeLine == 0 && isDelimiterCommand(rest):
+			if fields := strings.Fields(rest[:lineLength(rest)]); len(fields) == 2 {
+				delimiter = fields[1]
+			}
+			skip(i + lineLength(rest))
+			start = i
+			continue
+		case strings.HasPrefix(rest, delimiter) && (depth == 0 || delimiter != ";"):
+			end(i)
+			skip(i + len(delimiter))
+			start = i
+			continue
+		}
+
+		if codeLine == 0 {
+			codeLine = line
+		}
+
+		switch {
+		case rest[0] == '\'', rest[0] == '"', rest[0] == '`':
+			escapes := dialect.BackslashEscapes || (rest[0] == '\'' && isEscapeStringPrefix(contents, i))
+			skip(i + quotedLength(rest, escapes))
+		case rest[0] == '$':
+			tag := dollarTag(contents, i)
+			if tag == "" {
+				skip(i + 1)
+			} else if j := strings.Index(rest[len(tag):], tag); j >= 0 {
+				skip(i + len(tag) + j + len(tag))
+			} else {
+				skip(len(contents))
+			}
+		case isWordStart(contents, i):
+			word := strings.ToLower(rest[:wordLength(rest)])
+			if words == 0 {
+				create = word == "create"
+			}
+			words++
+			skip(i + len(word))
+
+			switch word {
+			case "trigger", "function", "procedure", "event":
+				routine = routine || (create && depth == 0)
+			case "begin":
+				if routine {
+					depth++
+				}
+			case "case":
+				if depth > 0 {
+					depth++
+				}
+			case "end":
+				if depth == 0 {
+					break
+				}
+				// END IF, END LOOP etc. close blocks which aren't counted, but
+				// END CASE closes a CASE
+				next := nextWord(contents[i:])
+				switch strings.ToLower(next) {
+				case "if", "loop", "while", "repeat", "for":
+					skip(i + strings.Index(contents[i:], next) + len(next))
+				case "case":
+					skip(i + strings.Index(contents[i:], next) + len(next))
+					depth--
+				default:
+					depth--
+				}
+			}
+		default:
+			skip(i + 1)
+		}
+	}
+	end(len(contents))
+
+	return statements
+}
+
+// lineLength returns the length of the first line of s, excluding the newline
+func lineLength(s string) int {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return i
+	}
+
+	return len(s)
+}
+
+// blockCommentLength returns the length of the /* ... */ comment at the start
+// of s. If nested is set, each /* inside it must be closed before the
+// comment ends. An unterminated comment runs to the end of s.
+func blockCommentLength(s string, nested bool) int {
+	depth := 0
+	for i := 0; i+1 < len(s); i++ {
+		switch {
+		case s[i] == '/' && s[i+1] == '*' && (depth == 0 || nested):
+			depth++
+			i++
+		case s[i] == '*' && s[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return len(s)
+}
+
+// isDelimiterCommand reports whether s starts with a `DELIMITER` line
+func isDelimiterCommand(s string) bool {
+	const command = "delimiter"
+	return len(s) > len(command) && strings.EqualFold(s[:len(command)], command) &&
+		(s[len(command)] == ' ' || s[len(command)] == '\t')
+}
+
+// quotedLength returns the length of the quoted string or identifier at the
+// start of s, including its quotes. A doubled quote stands for itself, and
+// if escapes is set a backslash escapes the next character inside strings.
+// An unterminated quote runs to the end of s.
+func quotedLength(s string, escapes bool) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if escapes && quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
+
+// dollarTag returns the tag (e.g. $$ or $body$) which opens a dollar-quoted
+// string at s[i], or "" if there isn't one
+func dollarTag(s string, i int) string {
+	if i > 0 && isIdentifierChar(s[i-1]) {
+		return ""
+	}
+
+	j := i + 1
+	for ; j < len(s) && isIdentifierChar(s[j]); j++ {
+		// tags can't start with a digit, which would be a parameter like $1
+		if j == i+1 && s[j] >= '0' && s[j] <= '9' {
+			return ""
+		}
+	}
+	if j < len(s) && s[j] == '$' {
+		return s[i : j+1]
+	}
+
+	return ""
+}
+
+// isEscapeStringPrefix reports whether the quote at s[i] opens a Postgres
+// escape string, like E'it\'s'
+func isEscapeStringPrefix(s string, i int) bool {
+	return i > 0 && (s[i-1] == 'E' || s[i-1] == 'e') && (i == 1 || !isWordChar(s[i-2]))
+}
+
+// isWordStart reports whether a keyword or identifier starts at s[i]
+func isWordStart(s string, i int) bool {
+	c := s[i]
+	if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+		return false
+	}
+
+	return i == 0 || !isWordChar(s[i-1])
+}
+
+// isWordChar reports whether c can be part of a word, including the qualified
+// names (like t.end) and Postgres identifiers containing $ (like a$b) whose
+// parts aren't words of their own
+func isWordChar(c byte) bool {
+	return isIdentifierChar(c) || c == '$' || c == '.'
+}
+
+// wordLength returns the length of the word at the start of s
+func wordLength(s string) int {
+	i := 0
+	for i < len(s) && isIdentifierChar(s[i]) {
+		i++
+	}
+
+	return i
+}
+
+// nextWord returns the word following any whitespace at the start of s, or ""
+// if something else comes next
+func nextWord(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+
+	return s[:wordLength(s)]
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
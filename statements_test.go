@@ -0,0 +1,182 @@
+package dbmate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		dialect  sqlDialect
+		expected []sqlStatement
+	}{
+		{
+			name:     "empty",
+			contents: "\n  \n-- only a comment;\n/* and another; */\n",
+			expected: []sqlStatement{},
+		},
+		{
+			name:     "multiple",
+			contents: "\ncreate table t1 (id integer);\n\ncreate table t2 (id integer)",
+			expected: []sqlStatement{
+				{SQL: "create table t1 (id integer)", Line: 2},
+				{SQL: "create table t2 (id integer)", Line: 4},
+			},
+		},
+		{
+			name:     "quotes",
+			contents: "select 'a;b', 'it''s;', \"c;d\", `e;f`; select 1",
+			expected: []sqlStatement{
+				{SQL: "select 'a;b', 'it''s;', \"c;d\", `e;f`", Line: 1},
+				{SQL: "select 1", Line: 1},
+			},
+		},
+		{
+			name:     "backslash escapes",
+			contents: "select 'x\\';y', \"c\\\";d\"; select 1",
+			dialect:  sqlDialect{BackslashEscapes: true},
+			expected: []sqlStatement{
+				{SQL: "select 'x\\';y', \"c\\\";d\"", Line: 1},
+				{SQL: "select 1", Line: 1},
+			},
+		},
+		{
+			name:     "no backslash escapes",
+			contents: "select 'C:\\'; select E'x\\';y', e'\\\\'; select 1",
+			expected: []sqlStatement{
+				{SQL: "select 'C:\\'", Line: 1},
+				{SQL: "select E'x\\';y', e'\\\\'", Line: 1},
+				{SQL: "select 1", Line: 1},
+			},
+		},
+		{
+			name:     "comments",
+			contents: "-- first;\nselect 1; -- second;\n/* third;\n */ select 2;",
+			expected: []sqlStatement{
+				{SQL: "-- first;\nselect 1", Line: 2},
+				{SQL: "-- second;\n/* third;\n */ select 2", Line: 4},
+			},
+		},
+		{
+			name:     "hash comments",
+			contents: "# don't split;\ncreate table a (id integer); # or here;\ncreate table b (id integer);",
+			dialect:  sqlDialect{HashComments: true},
+			expected: []sqlStatement{
+				{SQL: "# don't split;\ncreate table a (id integer)", Line: 2},
+				{SQL: "# or here;\ncreate table b (id integer)", Line: 3},
+			},
+		},
+		{
+			name:     "hash without hash comments",
+			contents: "select 1 # 2; select 3",
+			expected: []sqlStatement{
+				{SQL: "select 1 # 2", Line: 1},
+				{SQL: "select 3", Line: 1},
+			},
+		},
+		{
+			name:     "nested comments",
+			contents: "/* a /* b */ ; */ create table a (id integer);\nselect 1;",
+			dialect:  sqlDialect{NestedComments: true},
+			expected: []sqlStatement{
+				{SQL: "/* a /* b */ ; */ create table a (id integer)", Line: 1},
+				{SQL: "select 1", Line: 2},
+			},
+		},
+		{
+			name:     "unnested comments",
+			contents: "/* a /* b */ select 1; /* c */ select 2;",
+			expected: []sqlStatement{
+				{SQL: "/* a /* b */ select 1", Line: 1},
+				{SQL: "/* c */ select 2", Line: 1},
+			},
+		},
+		{
+			name: "dollar quotes",
+			contents: "create function f() returns int as $$ begin; return 1; end $$ language plpgsql;\n" +
+				"create function g() returns int as $body$ select $1; $body$ language sql;\n" +
+				"select a$b from t;",
+			expected: []sqlStatement{
+				{SQL: "create function f() returns int as $$ begin; return 1; end $$ language plpgsql", Line: 1},
+				{SQL: "create function g() returns int as $body$ select $1; $body$ language sql", Line: 2},
+				{SQL: "select a$b from t", Line: 3},
+			},
+		},
+		{
+			name: "delimiter",
+			contents: "DELIMITER //\ncreate trigger t before insert on t1\nfor each row begin\n" +
+				"  set new.id = 1;\nend//\ndelimiter ;\nselect 1;",
+			expected: []sqlStatement{
+				{SQL: "create trigger t before insert on t1\nfor each row begin\n  set new.id = 1;\nend", Line: 2},
+				{SQL: "select 1", Line: 7},
+			},
+		},
+		{
+			name: "sqlite trigger",
+			contents: "create trigger t after insert on t1\nbegin\n" +
+				"  update t2 set n = case when n > 0 then n + 1 else 1 end;\n" +
+				"  insert into t3 (id) values (new.id);\nend;\nselect 1;",
+			expected: []sqlStatement{
+				{SQL: "create trigger t after insert on t1\nbegin\n" +
+					"  update t2 set n = case when n > 0 then n + 1 else 1 end;\n" +
+					"  insert into t3 (id) values (new.id);\nend", Line: 1},
+				{SQL: "select 1", Line: 6},
+			},
+		},
+		{
+			name: "mysql compound statement",
+			contents: "CREATE PROCEDURE p()\nBEGIN\n  IF 1 THEN SELECT 1; END IF;\n" +
+				"  CASE 1 WHEN 1 THEN SELECT 2; END CASE;\n  loop1: LOOP LEAVE loop1; END LOOP;\nEND;\nSELECT 3;",
+			expected: []sqlStatement{
+				{SQL: "CREATE PROCEDURE p()\nBEGIN\n  IF 1 THEN SELECT 1; END IF;\n" +
+					"  CASE 1 WHEN 1 THEN SELECT 2; END CASE;\n  loop1: LOOP LEAVE loop1; END LOOP;\nEND", Line: 1},
+				{SQL: "SELECT 3", Line: 7},
+			},
+		},
+		{
+			name: "begin atomic",
+			contents: "create function f() returns int language sql\nbegin atomic\n" +
+				"  select 1;\n  select case when true then 2 end;\nend;\nselect f();",
+			expected: []sqlStatement{
+				{SQL: "create function f() returns int language sql\nbegin atomic\n" +
+					"  select 1;\n  select case when true then 2 end;\nend", Line: 1},
+				{SQL: "select f()", Line: 6},
+			},
+		},
+		{
+			name: "begin and end elsewhere",
+			contents: "begin;\ncreate table t1 (begin integer, \"end\" integer);\n" +
+				"select case when t1.begin > 0 then 1 end from t1;\ncommit;",
+			expected: []sqlStatement{
+				{SQL: "begin", Line: 1},
+				{SQL: "create table t1 (begin integer, \"end\" integer)", Line: 2},
+				{SQL: "select case when t1.begin > 0 then 1 end from t1", Line: 3},
+				{SQL: "commit", Line: 4},
+			},
+		},
+		{
+			name:     "unterminated",
+			contents: "select 1; select 'a;",
+			expected: []sqlStatement{
+				{SQL: "select 1", Line: 1},
+				{SQL: "select 'a;", Line: 1},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			statements := splitStatements(c.contents, c.dialect)
+
+			// check each offset, then ignore them to compare the rest
+			for i, stmt := range statements {
+				require.Equal(t, stmt.SQL, c.contents[stmt.Offset:stmt.Offset+len(stmt.SQL)])
+				statements[i].Offset = 0
+			}
+			require.Equal(t, c.expected, statements)
+		})
+	}
+}
@@ -1,10 +1,28 @@
 package dbmate
 
 import (
+	"context"
+	"database/sql"
 	"io"
+	"io/fs"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// splitTableName splits a table name which may be qualified with a schema,
+// such as ops.schema_migrations, into the schema (if any) and the table
+func splitTableName(table string) (string, string) {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+
+	return "", table
+}
+
 // databaseName returns the database name from a URL
 func databaseName(u *url.URL) string {
 	name := u.Path
@@ -15,8 +33,76 @@ func databaseName(u *url.URL) string {
 	return name
 }
 
+// readDir reads a directory from fsys, or from the OS filesystem if fsys is nil
+func readDir(fsys fs.FS, dir string) ([]fs.DirEntry, error) {
+	if fsys == nil {
+		return os.ReadDir(dir)
+	}
+
+	return fs.ReadDir(fsys, fsPath(dir))
+}
+
+// readFile reads a file from fsys, or from the OS filesystem if fsys is nil
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+	if fsys == nil {
+		return os.ReadFile(name)
+	}
+
+	return fs.ReadFile(fsys, fsPath(name))
+}
+
+// fsPath converts an OS path such as "./db/migrations" to the slash separated
+// form used by fs.FS, e.g. "db/migrations"
+func fsPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
 func mustClose(c io.Closer) {
 	if err := c.Close(); err != nil {
 		panic(err)
 	}
 }
+
+// queryColumn runs a query and returns the first column of every row
+func queryColumn(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(rows)
+
+	result := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+
+	return result, rows.Err()
+}
+
+// quoteLiteral quotes a string for use as a SQL literal
+func quoteLiteral(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+// nullTime converts a zero time to nil, so that it is stored as NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// nullExecutionMs converts an unknown (negative) execution time to nil, so
+// that it is stored as NULL
+func nullExecutionMs(ms int64) interface{} {
+	if ms < 0 {
+		return nil
+	}
+
+	return ms
+}